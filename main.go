@@ -2,519 +2,6493 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
 	"log"
+	"math"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// Scene is a parsed .lrlogic drawing in SVG coordinates (origin top-left,
+// +Y down, from the top-left corner of the LRVIEWBOX if there is one).
+// Every output format is written from a Scene, and --emit json writes it
+// as is.
+type Scene struct {
+	Width         int          `json:"width"`
+	Height        int          `json:"height"`
+	OutputWidth   int          `json:"outputWidth,omitempty"`  // LRRESDEFINEX with LRVIEWBOX, or --width (see pixelScale)
+	OutputHeight  int          `json:"outputHeight,omitempty"` // LRRESDEFINEY with LRVIEWBOX, or --height
+	MarginTop     int          `json:"marginTop"`
+	MarginBottom  int          `json:"marginBottom"`
+	FontSize      int          `json:"fontSize"`
+	CurveStrength int          `json:"curveStrength"`
+	BgR           int          `json:"bgR"`
+	BgG           int          `json:"bgG"`
+	BgB           int          `json:"bgB"`
+	Transparent   bool         `json:"transparent"`
+	TopText       string       `json:"topText"`
+	BottomText    string       `json:"bottomText"`
+	TopLine       bool         `json:"topLine"`
+	BottomLine    bool         `json:"bottomLine"`
+	Shapes        []Shape      `json:"shapes"`
+	Clips         []ClipRegion `json:"clips,omitempty"`    // clip id n is Clips[n-1]
+	Duration      float64      `json:"duration,omitempty"` // LRDURATION seconds, 0 to end at the last keyframe
+	Repeat        int          `json:"repeat,omitempty"`   // LRLOOP count, 0 to loop forever
+	Warnings      []string     `json:"-"`                  // skipped lines, as "line N: reason"
+	Responsive    bool         `json:"-"`                  // --responsive, SVG sized to its container
+}
+
+// pixelScale returns how many output pixels one scene unit is. The scene
+// keeps its aspect ratio and fits in OutputWidth x OutputHeight; when only
+// one of them is set it gives the size on its own.
+func (s *Scene) pixelScale() float64 {
+	sx := float64(s.OutputWidth) / float64(s.Width)
+	sy := float64(s.OutputHeight) / float64(s.Height)
+	switch {
+	case s.OutputWidth > 0 && s.OutputHeight > 0:
+		return math.Min(sx, sy)
+	case s.OutputWidth > 0:
+		return sx
+	case s.OutputHeight > 0:
+		return sy
+	}
+	return 1
+}
+
+// Shape is one primitive of a Scene, in draw order. Kind is "line",
+// "circle", "square" or "polygon":
+//   - a line runs from Points[0] to Points[1], bent by the scene's
+//     CurveStrength (see curveLine);
+//   - a circle is centered on Points[0] with radius Size;
+//   - a square has its top-left corner at Points[0] and side Size;
+//   - a polygon is an auto-detected closed shape, filled with its color and
+//     outlined in black.
+type Shape struct {
+	Kind    string      `json:"kind"`
+	Points  []Point     `json:"points"`
+	Size    int         `json:"size,omitempty"`
+	R       int         `json:"r"`
+	G       int         `json:"g"`
+	B       int         `json:"b"`
+	Fill    bool        `json:"fill"`
+	Style   StrokeStyle `json:"style"`
+	Markers LineMarkers `json:"markers"`
+	Clip    int         `json:"clip,omitempty"`
+	ID      string      `json:"id,omitempty"` // optional "#name" from the file
+	// Keyframes animate the shape in SVG output. The shape itself is
+	// frame 0 and is what every other format draws.
+	Keyframes []Keyframe `json:"keyframes,omitempty"`
+}
+
+// Keyframe is an LRANIMATE key: the points, size and color of its shape
+// Time seconds into the animation, in the same form as the Shape's. In
+// between keys the values change linearly.
+type Keyframe struct {
+	Time   float64 `json:"time"`
+	Points []Point `json:"points"`
+	Size   int     `json:"size,omitempty"`
+	R      int     `json:"r"`
+	G      int     `json:"g"`
+	B      int     `json:"b"`
+}
+
 type Point struct {
-	X, Y int
+	X int `json:"x"`
+	Y int `json:"y"`
 }
 
 type ColoredLine struct {
 	Start, End Point
 	R, G, B    int
+	Style      StrokeStyle
+	Markers    LineMarkers
+	Clip       int
+	ID         string
+	Keyframes  []Keyframe
+}
+
+// ClipRegion is an LRCLIP region in SVG coordinates. Kind is "rect",
+// "circle", "poly" or "margin"; a margin region is resolved against the
+// final LRMARGIN values when the SVG is written. Parent is the enclosing
+// region's id, or 0, so nested regions intersect.
+type ClipRegion struct {
+	Kind   string  `json:"kind"`
+	X      int     `json:"x,omitempty"`
+	Y      int     `json:"y,omitempty"`
+	W      int     `json:"w,omitempty"`
+	H      int     `json:"h,omitempty"`
+	R      int     `json:"r,omitempty"`
+	Points []Point `json:"points,omitempty"`
+	Parent int     `json:"parent,omitempty"`
+}
+
+// LineMarkers names the marker drawn at each end of a line: "arrow", "dot",
+// "bar" or "" for none.
+type LineMarkers struct {
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+
+// StrokeStyle holds the LRDASH, LRCAP and LRJOIN state that applies to every
+// stroke drawn after it is set. The zero value is a solid stroke with the
+// SVG default caps and joins.
+type StrokeStyle struct {
+	Dash []int  `json:"dash,omitempty"`
+	Cap  string `json:"cap,omitempty"`
+	Join string `json:"join,omitempty"`
 }
 
+// logOut receives status and verbose messages. It is stdout unless the
+// rendered output itself goes to stdout.
+var logOut io.Writer = os.Stdout
+
 func main() {
-	filepathFlag := flag.String("file", "", "Path to the .lrlogic file (required)")
-	nojpg := flag.Bool("nojpg", false, "Do not generate JPG output")
-	nosvg := flag.Bool("nosvg", false, "Delete SVG output after generating JPG")
-	verbose := flag.Bool("verbose", false, "Enable verbose output")
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		os.Exit(runRender(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		os.Exit(runServe(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(runVerify(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "imgdiff" {
+		os.Exit(runImgDiff(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "fromjson" {
+		os.Exit(runFromJSON(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "preview" {
+		os.Exit(runPreview(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "tween" {
+		os.Exit(runTween(os.Args[2:]))
+	}
+
+	filepathFlag := flag.String("file", "", "Path to the .lrlogic file, or - to read stdin (required)")
+	flags := addOutputFlags(flag.CommandLine)
+	stdout := flag.Bool("stdout", false, "Write the single output format to stdout instead of a file")
+	watch := flag.Bool("watch", false, "Keep running and render again whenever the file changes")
+	series := flag.Bool("series", false, "Read the numbered files following --file (frame001, frame002, ...) as further pages")
 	flag.Parse()
 
 	if *filepathFlag == "" {
-		fmt.Println("Usage: lrlogic --file filename.lrlogic [--nojpg] [--nosvg] [--verbose]")
+		fmt.Println("Usage: lrlogic --file filename.lrlogic [--format svg,png,jpg,pdf,gif,eps,dxf,gcode,hpgl] [--nojpg] [--nosvg] [--quality N] [--scale N] [--width N] [--height N] [--responsive] [--page A4] [--out path] [--outdir dir] [--force] [--stdout] [--watch] [--series] [--emit json] [--external] [--legacy-flip] [--verbose]")
+		fmt.Println("       lrlogic render [flags] 'pattern.lrlogic' ...")
+		fmt.Println("       lrlogic serve --file filename.lrlogic [--addr 127.0.0.1:8080]")
+		fmt.Println("       lrlogic verify [--tests Tests] [--refs tests_rendered] [--update]")
+		fmt.Println("       lrlogic imgdiff [--out diff.png] [--threshold P] a b")
+		fmt.Println("       lrlogic fromjson [--out file.lrlogic] scene.json")
+		fmt.Println("       lrlogic preview --file filename.lrlogic [--cols N] [--mode blocks|braille]")
+		fmt.Println("       lrlogic tween [--frames N] [--ease linear|in|out|inout] [--match order|id] [--format gif] a b")
 		os.Exit(1)
 	}
 
-	file, err := os.Open(*filepathFlag)
+	defaultFormats := "svg,jpg"
+	if *stdout {
+		// Status messages move to stderr so stdout carries only the output.
+		logOut = os.Stderr
+		defaultFormats = "svg"
+	}
+	opts, err := flags.options(defaultFormats)
 	if err != nil {
-		log.Fatalf("Failed to open file: %v", err)
+		log.Fatal(err)
+	}
+	if *stdout {
+		if len(opts.Formats) != 1 {
+			log.Fatal("--stdout needs exactly one output format")
+		}
+		if opts.Out != "" || opts.OutDir != "" {
+			log.Fatal("--stdout cannot be combined with --out or --outdir")
+		}
+	}
+
+	if *series && (*watch || *filepathFlag == "-") {
+		log.Fatal("--series needs a numbered file and cannot be combined with --watch")
+	}
+	if *watch {
+		if *stdout || *filepathFlag == "-" {
+			log.Fatal("--watch needs a file to watch and cannot be combined with --stdout")
+		}
+		watchFile(*filepathFlag, opts, *flags.verbose)
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
+	opts.SourceDir = filepath.Dir(*filepathFlag)
+	baseName := strings.TrimSuffix(filepath.Base(*filepathFlag), filepath.Ext(*filepathFlag))
+	input := io.Reader(os.Stdin)
+	if *filepathFlag == "-" {
+		opts.SourceDir = "."
+		baseName = "stdin"
+	} else {
+		file, err := os.Open(*filepathFlag)
+		if err != nil {
+			log.Fatalf("Failed to open file: %v", err)
+		}
+		defer file.Close()
+		input = file
+	}
 
-	// Detect file version
-	if !scanner.Scan() {
-		log.Fatal("File is empty!")
+	pages, err := parseLRLogic(input, *flags.verbose, opts.LegacyFlip)
+	if err != nil {
+		log.Fatal(err)
 	}
-	header := scanner.Text()
-	isV2 := false
-	if header == "LRFILE VERSION 2" {
-		isV2 = true
-		if *verbose {
-			fmt.Println("Detected LRFILE VERSION 2")
+	if *series {
+		var rest []string
+		rest, baseName, err = seriesFiles(*filepathFlag)
+		if err != nil {
+			log.Fatal(err)
 		}
-	} else if header == "LRLOGIC FILE FORMAT V1" {
-		isV2 = false
-		if *verbose {
-			fmt.Println("Detected LRLOGIC FILE FORMAT V1")
+		for _, path := range rest {
+			file, err := os.Open(path)
+			if err != nil {
+				log.Fatalf("Failed to open file: %v", err)
+			}
+			more, err := parseLRLogic(file, *flags.verbose, opts.LegacyFlip)
+			file.Close()
+			if err != nil {
+				log.Fatalf("%s: %v", path, err)
+			}
+			pages = append(pages, more...)
 		}
+		fmt.Fprintf(logOut, "Read %d files of the %s series\n", len(rest)+1, baseName)
+	}
+
+	if *stdout {
+		err = writeStdout(os.Stdout, pages, opts)
 	} else {
-		log.Fatal("Invalid file header!")
+		err = writeOutputs(pages, baseName, opts)
+	}
+	if err != nil {
+		log.Print(err)
 		os.Exit(1)
 	}
+}
 
-	// Defaults
-	width := 640
-	height := 480
-	marginTop := 20
-	marginBottom := 20
-	fontSize := 16
-	curveStrength := 5
+// seriesFiles returns the files that follow first in a numbered series,
+// frame001.lrlogic, frame002.lrlogic and so on up to the first one that
+// is missing, and the name of the series without the number.
+func seriesFiles(first string) ([]string, string, error) {
+	ext := filepath.Ext(first)
+	stem := strings.TrimSuffix(first, ext)
+	i := len(stem)
+	for i > 0 && stem[i-1] >= '0' && stem[i-1] <= '9' {
+		i--
+	}
+	digits := stem[i:]
+	n, err := strconv.Atoi(digits)
+	if err != nil {
+		return nil, "", fmt.Errorf("--series needs a file name ending in a number, got %s", first)
+	}
+	var rest []string
+	for {
+		n++
+		path := fmt.Sprintf("%s%0*d%s", stem[:i], len(digits), n, ext)
+		if _, err := os.Stat(path); err != nil {
+			break
+		}
+		rest = append(rest, path)
+	}
+	name := filepath.Base(stem)
+	name = strings.TrimRight(name[:len(name)-len(digits)], "-_. ")
+	if name == "" {
+		name = "series"
+	}
+	return rest, name, nil
+}
 
-	var paths []string
-	var topText, bottomText string
-	var topLine, bottomLine bool
-	var coloredLines []ColoredLine
+// outputFlags are the command line flags shared by single file mode and
+// the render subcommand.
+type outputFlags struct {
+	format, emit, page, units, out, outDir *string
+	nojpg, nosvg, external, force, verbose *bool
+	quality, width, height                 *int
+	scale                                  *float64
+	plot                                   plotFlags
+	gif                                    gifFlags
+	legacyFlip, responsive                 *bool
+}
 
-	// Fill mode logic:
-	fillMode := true // default fill mode
-	if isV2 {
-		fillMode = false // for v2 start off with no fill until LRFILL ON is encountered
+// gifFlags are the flags that fill in gifOptions.
+type gifFlags struct {
+	delay, loop, colors *int
+	dither              *bool
+}
+
+// plotFlags are the flags that fill in plotOptions.
+type plotFlags struct {
+	scale, tolerance, feed    *float64
+	hatch, hatchAng           *float64
+	penUp, penDown, penChange *string
+	optimize                  *bool
+}
+
+// addLegacyFlag registers --legacy-flip, which every subcommand that reads
+// .lrlogic files takes. Pass its value on to parseLRLogic.
+func addLegacyFlag(fs *flag.FlagSet) *bool {
+	return fs.Bool("legacy-flip", false, "Put 0,0 of V1 files at the bottom left like older versions did")
+}
+
+func addOutputFlags(fs *flag.FlagSet) *outputFlags {
+	return &outputFlags{
+		format:   fs.String("format", "", "Comma-separated output formats: svg, png, jpg, pdf, gif, eps, dxf, gcode, hpgl (default svg,jpg)"),
+		emit:     fs.String("emit", "", "Write the parsed scene instead of rendering it: json"),
+		nojpg:    fs.Bool("nojpg", false, "Do not generate JPG output"),
+		nosvg:    fs.Bool("nosvg", false, "Delete SVG output after generating JPG"),
+		quality:  fs.Int("quality", 90, "JPG quality (1-100)"),
+		scale:    fs.Float64("scale", 1, "Scale factor for raster output (e.g. 2 for high-DPI)"),
+		width:    fs.Int("width", 0, "Output width in pixels, keeping the aspect ratio (default the canvas size)"),
+		height:   fs.Int("height", 0, "Output height in pixels, keeping the aspect ratio (default the canvas size)"),
+		page:     fs.String("page", "fit", "PDF page size: fit, A3, A4, A5, Letter or Legal"),
+		units:    fs.String("units", "mm", "DXF drawing units for one canvas unit: none, in, ft, mm, cm or m"),
+		external: fs.Bool("external", false, "Convert to raster formats with rsvg-convert or ImageMagick instead of the built-in renderer"),
+		out:      fs.String("out", "", "Output path template using {name}, {ext} and {dir} (default {name}.{ext})"),
+		outDir:   fs.String("outdir", "", "Directory to write output files into"),
+		force:    fs.Bool("force", false, "Overwrite existing files when using --out or --outdir"),
+		verbose:  fs.Bool("verbose", false, "Enable verbose output"),
+		plot: plotFlags{
+			scale:     fs.Float64("plotscale", 0.25, "G-code/HPGL millimetres per canvas unit"),
+			tolerance: fs.Float64("tolerance", 0.1, "G-code/HPGL curve flattening tolerance in millimetres"),
+			feed:      fs.Float64("feed", 3000, "G-code/HPGL drawing speed in mm/min"),
+			penUp:     fs.String("penup", "G0 Z5", "G-code command that lifts the pen"),
+			penDown:   fs.String("pendown", "G0 Z0", "G-code command that lowers the pen"),
+			optimize:  fs.Bool("optimize", false, "Reorder and merge G-code/HPGL strokes to cut pen-up travel, and reorder DXF lines"),
+			hatch:     fs.Float64("hatch", 0, "G-code/HPGL hatch line spacing in millimetres for fills (0 leaves fills out)"),
+			hatchAng:  fs.Float64("hatch-angle", 45, "G-code/HPGL hatch line angle in degrees"),
+			penChange: fs.String("penchange", "M0 ; change to pen {pen}, rgb({r},{g},{b})", "G-code for a pen change, with {pen}, {r}, {g} and {b}"),
+		},
+		gif: gifFlags{
+			delay:  fs.Int("delay", 100, "GIF frame delay in milliseconds, also the step animations are sampled at"),
+			loop:   fs.Int("loop", -1, "GIF play count, 0 to loop forever (default from LRLOOP)"),
+			colors: fs.Int("colors", 256, "GIF palette size (2-256)"),
+			dither: fs.Bool("dither", false, "Dither GIF frames instead of mapping to the nearest palette color"),
+		},
+		legacyFlip: addLegacyFlag(fs),
+		responsive: fs.Bool("responsive", false, "Size the SVG to 100% of its container, using a viewBox"),
 	}
+}
 
-	lineNum := 1 // counting from line after header
-	for scanner.Scan() {
-		lineNum++
-		line := strings.TrimSpace(scanner.Text())
-		if *verbose {
-			fmt.Printf("Processing line %d: %s\n", lineNum, line)
+// options checks the parsed flags and turns them into outputOptions.
+// defaultFormats is used when --format is not given. SourceDir is left
+// for the caller since it depends on the input file.
+func (f *outputFlags) options(defaultFormats string) (outputOptions, error) {
+	list := *f.format
+	if list == "" {
+		list = defaultFormats
+	}
+	formats, err := parseFormats(list, *f.nojpg, *f.nosvg)
+	if err != nil {
+		return outputOptions{}, err
+	}
+	switch *f.emit {
+	case "":
+	case "json":
+		if *f.format != "" {
+			return outputOptions{}, errors.New("--emit cannot be combined with --format")
 		}
+		formats = []string{"json"}
+	default:
+		return outputOptions{}, fmt.Errorf("Unknown --emit value %q, only json is supported", *f.emit)
+	}
+	if *f.quality < 1 || *f.quality > 100 {
+		return outputOptions{}, fmt.Errorf("Invalid --quality %d, must be between 1 and 100", *f.quality)
+	}
+	if *f.scale <= 0 {
+		return outputOptions{}, fmt.Errorf("Invalid --scale %v, must be greater than 0", *f.scale)
+	}
+	if *f.width < 0 || *f.height < 0 {
+		return outputOptions{}, errors.New("--width and --height must not be negative")
+	}
+	if _, _, ok := pageSize(*f.page); !ok {
+		return outputOptions{}, fmt.Errorf("Unknown --page size %q", *f.page)
+	}
+	if _, ok := dxfUnits[*f.units]; !ok {
+		return outputOptions{}, fmt.Errorf("Unknown --units %q", *f.units)
+	}
+	if *f.plot.scale <= 0 || *f.plot.tolerance <= 0 || *f.plot.feed <= 0 {
+		return outputOptions{}, errors.New("--plotscale, --tolerance and --feed must be greater than 0")
+	}
+	if *f.plot.hatch < 0 {
+		return outputOptions{}, errors.New("--hatch must not be negative")
+	}
+	if *f.gif.delay < 10 {
+		return outputOptions{}, fmt.Errorf("Invalid --delay %d, must be at least 10 ms", *f.gif.delay)
+	}
+	if *f.gif.colors < 2 || *f.gif.colors > 256 {
+		return outputOptions{}, fmt.Errorf("Invalid --colors %d, must be between 2 and 256", *f.gif.colors)
+	}
+	if *f.out != "" && !strings.Contains(*f.out, "{ext}") && len(formats) > 1 {
+		return outputOptions{}, errors.New("--out needs {ext} when more than one format is written")
+	}
+	return outputOptions{
+		Formats:  formats,
+		Quality:  *f.quality,
+		Scale:    *f.scale,
+		Width:    *f.width,
+		Height:   *f.height,
+		Page:     *f.page,
+		Units:    *f.units,
+		External: *f.external,
+		Out:      *f.out,
+		OutDir:   *f.outDir,
+		Force:    *f.force,
+		Plot: plotOptions{
+			Scale:     *f.plot.scale,
+			Tolerance: *f.plot.tolerance,
+			Feed:      *f.plot.feed,
+			PenUp:     *f.plot.penUp,
+			PenDown:   *f.plot.penDown,
+			PenChange: *f.plot.penChange,
+			Optimize:  *f.plot.optimize,
+			Hatch:     *f.plot.hatch,
+			HatchAng:  *f.plot.hatchAng,
+		},
+		GIF: gifOptions{
+			Delay:  *f.gif.delay,
+			Loop:   *f.gif.loop,
+			Colors: *f.gif.colors,
+			Dither: *f.gif.dither,
+		},
+		Responsive: *f.responsive,
+		LegacyFlip: *f.legacyFlip,
+	}, nil
+}
 
-		if line == "LREXIT" {
-			if *verbose {
-				fmt.Println("Found LREXIT, stopping parse.")
-			}
-			break
+// resize returns the pages with --width, --height and --responsive
+// applied, leaving the parsed pages as they are.
+func (o outputOptions) resize(pages []*Scene) []*Scene {
+	if o.Width == 0 && o.Height == 0 && !o.Responsive {
+		return pages
+	}
+	sized := make([]*Scene, len(pages))
+	for i, scene := range pages {
+		s := *scene
+		if o.Width > 0 || o.Height > 0 {
+			s.OutputWidth, s.OutputHeight = o.Width, o.Height
 		}
+		s.Responsive = o.Responsive
+		sized[i] = &s
+	}
+	return sized
+}
 
-		if strings.HasPrefix(line, "LRRESDEFINEX") {
-			parts := strings.Fields(line)
-			if len(parts) == 2 {
-				if val, err := strconv.Atoi(parts[1]); err == nil {
-					width = val
-					if *verbose {
-						fmt.Printf("Set width to %d\n", width)
-					}
-				}
-			}
-			continue
+// watchInterval is how often --watch and serve check the source file.
+const watchInterval = 250 * time.Millisecond
+
+// watchFile renders path and then renders it again each time it changes.
+// It never returns; errors are printed and watching goes on so a
+// half-edited file does not end the session.
+func watchFile(path string, opts outputOptions, verbose bool) {
+	pollFile(path, func() {
+		if err := renderFile(path, opts, verbose); err != nil {
+			log.Print(err)
 		}
+		fmt.Fprintf(logOut, "Watching %s for changes...\n", path)
+		// The outputs from the previous round are ours to replace.
+		opts.Force = true
+	})
+}
 
-		if strings.HasPrefix(line, "LRRESDEFINEY") {
-			parts := strings.Fields(line)
-			if len(parts) == 2 {
-				if val, err := strconv.Atoi(parts[1]); err == nil {
-					height = val
-					if *verbose {
-						fmt.Printf("Set height to %d\n", height)
-					}
-				}
+// pollFile calls changed straight away and then every time the
+// modification time or size of path changes. It never returns.
+func pollFile(path string, changed func()) {
+	var last os.FileInfo
+	missing := false
+	for {
+		info, err := os.Stat(path)
+		if err != nil {
+			// Editors that save by renaming leave the file missing for a
+			// moment, so only report it once.
+			if !missing {
+				log.Print(err)
+				missing = true
 			}
+		} else if last == nil || !info.ModTime().Equal(last.ModTime()) || info.Size() != last.Size() {
+			missing = false
+			last = info
+			changed()
+		}
+		time.Sleep(watchInterval)
+	}
+}
+
+// maxVerifyDiffs is how many differences verify prints for one file.
+const maxVerifyDiffs = 20
+
+// runVerify is the verify subcommand. It renders the test inputs and
+// compares each SVG to its reference in tests_rendered, ignoring element
+// order and whitespace. With --update differing references are rewritten,
+// along with the reference JPG if there is one.
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	tests := fs.String("tests", "Tests", "Directory with the .lrlogic test inputs")
+	refs := fs.String("refs", "tests_rendered", "Directory with the reference SVG and JPG files")
+	update := fs.Bool("update", false, "Rewrite references that differ instead of failing")
+	verbose := fs.Bool("verbose", false, "Enable verbose output")
+	legacy := addLegacyFlag(fs)
+	patterns := parseArgs(fs, args)
+	if len(patterns) == 0 {
+		patterns = []string{filepath.Join(*tests, "*.lrlogic")}
+	}
+
+	files, failed := expandPatterns(patterns)
+	passed, updated := 0, 0
+	for _, path := range files {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", path, err)
+			failed++
+			continue
+		}
+		pages, err := parseLRLogic(file, *verbose, *legacy)
+		file.Close()
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", path, err)
+			failed++
 			continue
 		}
 
-		if strings.HasPrefix(line, "LRMARGIN") {
-			parts := strings.Fields(line)
-			if len(parts) == 3 {
-				if val, err := strconv.Atoi(parts[1]); err == nil {
-					marginTop = val
-					if *verbose {
-						fmt.Printf("Set marginTop to %d\n", marginTop)
-					}
+		baseName := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		for i, scene := range pages {
+			name := baseName
+			if i > 0 {
+				name = fmt.Sprintf("%s-%d", baseName, i+1)
+			}
+			var got bytes.Buffer
+			writeSVG(&got, scene)
+			refPath := filepath.Join(*refs, name+".svg")
+			diffs, err := verifySVG(refPath, got.Bytes())
+			if err == nil && len(diffs) == 0 {
+				fmt.Printf("PASS %s\n", name)
+				passed++
+				continue
+			}
+
+			if *update {
+				if err := updateReference(scene, got.Bytes(), refPath); err != nil {
+					fmt.Printf("FAIL %s: %v\n", name, err)
+					failed++
+					continue
 				}
-				if val, err := strconv.Atoi(parts[2]); err == nil {
-					marginBottom = val
-					if *verbose {
-						fmt.Printf("Set marginBottom to %d\n", marginBottom)
-					}
+				fmt.Printf("UPDATED %s\n", name)
+				updated++
+				continue
+			}
+			if err != nil {
+				fmt.Printf("FAIL %s: %v\n", name, err)
+			} else {
+				fmt.Printf("FAIL %s\n", name)
+			}
+			for j, d := range diffs {
+				if j == maxVerifyDiffs {
+					fmt.Printf("  ... and %d more differences\n", len(diffs)-j)
+					break
 				}
+				fmt.Printf("  %s\n", d)
 			}
-			continue
+			failed++
 		}
+	}
 
-		if strings.HasPrefix(line, "LRFONTSIZE") {
-			parts := strings.Fields(line)
-			if len(parts) == 2 {
-				if val, err := strconv.Atoi(parts[1]); err == nil {
-					fontSize = val
-					if *verbose {
-						fmt.Printf("Set fontSize to %d\n", fontSize)
-					}
-				}
+	fmt.Printf("Verified %d files: %d passed", passed+updated+failed, passed)
+	if updated > 0 {
+		fmt.Printf(", %d updated", updated)
+	}
+	fmt.Printf(", %d failed\n", failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// verifySVG compares the SVG in got to the reference file and returns the
+// differences, or an error if the reference can't be read or parsed.
+func verifySVG(refPath string, got []byte) ([]string, error) {
+	ref, err := os.ReadFile(refPath)
+	if err != nil {
+		return nil, err
+	}
+	want, err := svgElements(ref)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", refPath, err)
+	}
+	have, err := svgElements(got)
+	if err != nil {
+		return nil, err
+	}
+	return diffElements(want, have), nil
+}
+
+// updateReference writes svg to refPath and, if a JPG reference sits next
+// to it, renders the scene into that too.
+func updateReference(scene *Scene, svg []byte, refPath string) error {
+	if err := os.MkdirAll(filepath.Dir(refPath), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(refPath, svg, 0644); err != nil {
+		return err
+	}
+	jpgPath := strings.TrimSuffix(refPath, ".svg") + ".jpg"
+	if _, err := os.Stat(jpgPath); err != nil {
+		return nil
+	}
+	return writeFile(jpgPath, func(w io.Writer) error {
+		return writeJPG(w, renderImage(scene, scene.pixelScale()), 90)
+	})
+}
+
+// svgElement is one element of an SVG document flattened for comparison.
+// Path holds the names of the element and its parents, Attrs is sorted by
+// name and whitespace in attribute values and text is collapsed.
+type svgElement struct {
+	Path  string
+	Attrs []xml.Attr
+	Text  string
+}
+
+func (e svgElement) String() string {
+	var b strings.Builder
+	b.WriteString("<" + e.Path)
+	for _, a := range e.Attrs {
+		fmt.Fprintf(&b, " %s=%q", a.Name.Local, a.Value)
+	}
+	b.WriteString(">")
+	b.WriteString(e.Text)
+	return b.String()
+}
+
+// attr returns the value of the named attribute and whether it is set.
+func (e svgElement) attr(name string) (string, bool) {
+	for _, a := range e.Attrs {
+		if a.Name.Local == name {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// svgElements flattens an SVG document into its elements in document
+// order.
+func svgElements(data []byte) ([]svgElement, error) {
+	var elements []svgElement
+	var open []int // indexes into elements of the enclosing elements
+	var path []string
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return elements, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			path = append(path, t.Name.Local)
+			e := svgElement{Path: strings.Join(path, "/")}
+			for _, a := range t.Attr {
+				e.Attrs = append(e.Attrs, xml.Attr{Name: xml.Name{Local: a.Name.Local}, Value: collapseSpace(a.Value)})
+			}
+			sort.Slice(e.Attrs, func(i, j int) bool { return e.Attrs[i].Name.Local < e.Attrs[j].Name.Local })
+			open = append(open, len(elements))
+			elements = append(elements, e)
+		case xml.EndElement:
+			i := open[len(open)-1]
+			elements[i].Text = collapseSpace(elements[i].Text)
+			open = open[:len(open)-1]
+			path = path[:len(path)-1]
+		case xml.CharData:
+			if len(open) > 0 {
+				elements[open[len(open)-1]].Text += string(t)
 			}
-			continue
 		}
+	}
+}
 
-		if strings.HasPrefix(line, "LRCURVE") {
-			parts := strings.Fields(line)
-			if len(parts) == 2 {
-				if val, err := strconv.Atoi(parts[1]); err == nil {
-					curveStrength = val
-					if *verbose {
-						fmt.Printf("Set curveStrength to %d\n", curveStrength)
-					}
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// diffElements compares two element lists as multisets. Elements missing
+// from have are paired with the extra element at the same path that shares
+// the most attributes and reported as changes; the rest are reported as
+// missing or extra.
+func diffElements(want, have []svgElement) []string {
+	count := make(map[string]int)
+	for _, e := range have {
+		count[e.String()]++
+	}
+	var missing []svgElement
+	for _, e := range want {
+		if count[e.String()] > 0 {
+			count[e.String()]--
+		} else {
+			missing = append(missing, e)
+		}
+	}
+	var extra []svgElement
+	for _, e := range have {
+		if count[e.String()] > 0 {
+			count[e.String()]--
+			extra = append(extra, e)
+		}
+	}
+
+	var diffs []string
+	for _, m := range missing {
+		best, bestScore := -1, -1
+		for i, e := range extra {
+			if e.Path != m.Path {
+				continue
+			}
+			score := 0
+			for _, a := range m.Attrs {
+				if v, ok := e.attr(a.Name.Local); ok && v == a.Value {
+					score++
 				}
 			}
+			if score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		if best < 0 {
+			diffs = append(diffs, "missing "+m.String())
 			continue
 		}
+		diffs = append(diffs, fmt.Sprintf("changed %s: %s", m, attrChanges(m, extra[best])))
+		extra = append(extra[:best], extra[best+1:]...)
+	}
+	for _, e := range extra {
+		diffs = append(diffs, "extra   "+e.String())
+	}
+	return diffs
+}
 
-		if strings.HasPrefix(line, "LRTXT.Top") {
-			topText = extractText(line)
-			topLine = true
-			if *verbose {
-				fmt.Printf("Set topText: %s\n", topText)
-			}
-			continue
+// attrChanges describes how the attributes and text of b differ from a.
+func attrChanges(a, b svgElement) string {
+	var changes []string
+	names := make(map[string]bool)
+	for _, attr := range append(append([]xml.Attr{}, a.Attrs...), b.Attrs...) {
+		names[attr.Name.Local] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		av, aok := a.attr(name)
+		bv, bok := b.attr(name)
+		switch {
+		case !aok:
+			changes = append(changes, fmt.Sprintf("%s added %q", name, bv))
+		case !bok:
+			changes = append(changes, fmt.Sprintf("%s removed", name))
+		case av != bv:
+			changes = append(changes, fmt.Sprintf("%s %q -> %q", name, av, bv))
 		}
+	}
+	if a.Text != b.Text {
+		changes = append(changes, fmt.Sprintf("text %q -> %q", a.Text, b.Text))
+	}
+	return strings.Join(changes, ", ")
+}
 
-		if strings.HasPrefix(line, "LRTXT.Bottom") {
-			bottomText = extractText(line)
-			bottomLine = true
-			if *verbose {
-				fmt.Printf("Set bottomText: %s\n", bottomText)
-			}
-			continue
+// runImgDiff is the imgdiff subcommand. It rasterizes two inputs, counts
+// the pixels that differ and writes a heatmap of where. Like diff(1) it
+// exits with 1 when the inputs differ too much and 2 on errors.
+func runImgDiff(args []string) int {
+	fs := flag.NewFlagSet("imgdiff", flag.ExitOnError)
+	out := fs.String("out", "diff.png", "Path of the heatmap PNG")
+	scale := fs.Float64("scale", 1, "Scale factor to rasterize both inputs at")
+	tolerance := fs.Int("tolerance", 8, "Largest per-channel difference (0-255) still counted as a match")
+	threshold := fs.Float64("threshold", -1, "Exit with 1 when more than this percentage of pixels differ (off by default)")
+	legacy := addLegacyFlag(fs)
+	inputs := parseArgs(fs, args)
+	if len(inputs) != 2 {
+		fmt.Println("Usage: lrlogic imgdiff [--out diff.png] [--scale N] [--tolerance N] [--threshold P] a.lrlogic b.lrlogic")
+		return 2
+	}
+	if *scale <= 0 {
+		log.Printf("Invalid --scale %v, must be greater than 0", *scale)
+		return 2
+	}
+
+	a, err := rasterizeInput(inputs[0], *scale, *legacy)
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	b, err := rasterizeInput(inputs[1], *scale, *legacy)
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	// A render at another scale is compared after scaling it back, but
+	// stretching to another shape would hide a real change.
+	if sa, sb := a.Bounds().Size(), b.Bounds().Size(); sa != sb {
+		if math.Abs(float64(sb.Y*sa.X)/float64(sb.X)-float64(sa.Y)) > 1 {
+			log.Printf("Sizes differ: %v and %v have different aspect ratios", sa, sb)
+			return 2
+		}
+		fmt.Printf("Sizes differ: %v and %v, scaling the second to %v\n", sa, sb, sa)
+		b = resizeImage(b, sa.X, sa.Y)
+	}
+
+	heat, mismatched, total, maxDiff := imageDiff(a, b, *tolerance)
+	percent := 100 * float64(mismatched) / float64(total)
+	fmt.Printf("Mismatch: %d of %d pixels (%.2f%%), largest difference %d\n", mismatched, total, percent, maxDiff)
+
+	err = writeFile(*out, func(w io.Writer) error {
+		return png.Encode(w, heat)
+	})
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	fmt.Printf("Generated %s successfully.\n", *out)
+
+	if *threshold >= 0 && percent > *threshold {
+		fmt.Printf("Mismatch is above the %.2f%% threshold\n", *threshold)
+		return 1
+	}
+	return 0
+}
+
+// rasterizeInput renders a .lrlogic file (its first page) or an .svg file
+// written by lrlogic with the built-in renderer. Other SVG files go through
+// the external converter, since the built-in renderer only draws scenes.
+// PNG and JPG files are read as they are.
+func rasterizeInput(path string, scale float64, legacyFlip bool) (image.Image, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png", ".jpg", ".jpeg":
+		return decodeImage(path)
+	case ".svg":
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		scene, err := svgScene(data)
+		if err == nil {
+			return renderImage(scene, scale*scene.pixelScale()), nil
+		}
+		if err != errForeignSVG {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if !checkCommand("rsvg-convert") && !checkCommand("convert") {
+			return nil, fmt.Errorf("%s was not written by lrlogic, drawing it needs rsvg-convert or ImageMagick (convert) and neither is installed", path)
+		}
+		tmp, err := os.CreateTemp("", "lrlogic-*.png")
+		if err != nil {
+			return nil, err
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+		if err := convertExternal("png", path, tmp.Name(), scale); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return decodeImage(tmp.Name())
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	pages, err := parseLRLogic(file, false, legacyFlip)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return renderImage(pages[0], scale*pages[0].pixelScale()), nil
+}
+
+// errForeignSVG is returned by svgScene for SVG files lrlogic did not
+// write.
+var errForeignSVG = errors.New("not an lrlogic SVG")
+
+// svgScene reads an SVG written by writeSVG back into a Scene, so it can
+// be drawn with the built-in renderer. Animations are skipped, leaving
+// frame 0 like every format but SVG draws.
+func svgScene(data []byte) (*Scene, error) {
+	elements, err := svgElements(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(elements) == 0 || elements[0].Path != "svg" {
+		return nil, errForeignSVG
+	}
+	scene := &Scene{MarginTop: 20, MarginBottom: 20, FontSize: 16, BgR: 255, BgG: 255, BgB: 255, Transparent: true}
+	foreign := false
+	num := func(e svgElement, name string) int {
+		v, _ := e.attr(name)
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			foreign = true
+		}
+		return n
+	}
+
+	root := elements[0]
+	if vb, ok := root.attr("viewBox"); ok {
+		// Scaled or responsive output, drawn in scene units.
+		f := strings.Fields(vb)
+		if len(f) != 4 || f[0] != "0" || f[1] != "0" {
+			return nil, errForeignSVG
+		}
+		scene.Width, err = strconv.Atoi(f[2])
+		if err != nil {
+			return nil, errForeignSVG
+		}
+		scene.Height, err = strconv.Atoi(f[3])
+		if err != nil {
+			return nil, errForeignSVG
+		}
+		w, _ := root.attr("width")
+		h, _ := root.attr("height")
+		if fw, err := strconv.ParseFloat(w, 64); err == nil {
+			scene.OutputWidth = int(math.Round(fw))
+		}
+		if fh, err := strconv.ParseFloat(h, 64); err == nil {
+			scene.OutputHeight = int(math.Round(fh))
+		}
+	} else {
+		scene.Width, scene.Height = num(root, "width"), num(root, "height")
+	}
+
+	strength := 0
+	groupClip := 0
+	for _, e := range elements[1:] {
+		parts := strings.Split(e.Path, "/")
+		name := parts[len(parts)-1]
+		fill, _ := e.attr("fill")
+		stroke, _ := e.attr("stroke")
+		r, g, b, _ := svgColor(stroke)
+
+		if parts[1] == "defs" {
+			// Only the clip paths matter, markers are drawn from the
+			// shapes' marker attributes.
+			switch {
+			case len(parts) == 3 && name == "clipPath":
+				id, _ := e.attr("id")
+				if id != fmt.Sprintf("lr-clip-%d", len(scene.Clips)+1) {
+					return nil, errForeignSVG
+				}
+				scene.Clips = append(scene.Clips, ClipRegion{Parent: svgClip(e)})
+			case len(parts) == 4 && parts[2] == "clipPath" && len(scene.Clips) > 0:
+				region := &scene.Clips[len(scene.Clips)-1]
+				switch name {
+				case "rect":
+					region.Kind = "rect"
+					region.X, region.Y, region.W, region.H = num(e, "x"), num(e, "y"), num(e, "width"), num(e, "height")
+				case "circle":
+					region.Kind = "circle"
+					region.X, region.Y, region.R = num(e, "cx"), num(e, "cy"), num(e, "r")
+				case "polygon":
+					region.Kind = "poly"
+					v, _ := e.attr("points")
+					region.Points = svgPoints(v, &foreign)
+				}
+			}
+			continue
+		}
+		if len(parts) == 2 && name == "g" {
+			// A moving shape with a clip is wrapped in a clipped group.
+			groupClip = svgClip(e)
+			continue
+		}
+		clip := svgClip(e)
+		switch {
+		case len(parts) == 2:
+		case len(parts) == 3 && parts[1] == "g":
+			clip = groupClip
+		default:
+			continue // <animate> and the like
+		}
+
+		shape := Shape{R: r, G: g, B: b, Fill: fill != "none", Clip: clip}
+		if v, ok := e.attr("stroke-dasharray"); ok {
+			for _, d := range strings.Split(v, ",") {
+				n, err := strconv.Atoi(d)
+				if err != nil {
+					foreign = true
+				}
+				shape.Style.Dash = append(shape.Style.Dash, n)
+			}
+		}
+		shape.Style.Cap, _ = e.attr("stroke-linecap")
+		shape.Style.Join, _ = e.attr("stroke-linejoin")
+
+		switch name {
+		case "rect":
+			if _, ok := e.attr("x"); !ok {
+				// The background covers the canvas and has no position.
+				scene.Transparent = false
+				scene.BgR, scene.BgG, scene.BgB, _ = svgColor(fill)
+				continue
+			}
+			shape.Kind = "square"
+			shape.Points = []Point{{num(e, "x"), num(e, "y")}}
+			shape.Size = num(e, "width")
+			if num(e, "height") != shape.Size {
+				return nil, errForeignSVG
+			}
+		case "circle":
+			shape.Kind = "circle"
+			shape.Points = []Point{{num(e, "cx"), num(e, "cy")}}
+			shape.Size = num(e, "r")
+		case "polygon":
+			shape.Kind = "polygon"
+			v, _ := e.attr("points")
+			shape.Points = svgPoints(v, &foreign)
+			shape.R, shape.G, shape.B, _ = svgColor(fill)
+		case "path":
+			// M x1 y1 Q cx cy x2 y2, with the control point from
+			// curveControl.
+			d, _ := e.attr("d")
+			f := strings.Fields(d)
+			if len(f) != 8 || f[0] != "M" || f[3] != "Q" {
+				return nil, errForeignSVG
+			}
+			var v [6]int
+			for i, s := range append(f[1:3:3], f[4:]...) {
+				if v[i], err = strconv.Atoi(s); err != nil {
+					return nil, errForeignSVG
+				}
+			}
+			start, end := Point{v[0], v[1]}, Point{v[4], v[5]}
+			strength = (start.Y+end.Y)/2 - v[3]
+			if curveControl(start, end, strength) != (Point{v[2], v[3]}) {
+				return nil, errForeignSVG
+			}
+			shape.Kind = "line"
+			shape.Points = []Point{start, end}
+			shape.Markers.Start = svgMarker(e, "marker-start")
+			shape.Markers.End = svgMarker(e, "marker-end")
+		case "line":
+			// Text separator
+			if num(e, "y1") < scene.Height/2 {
+				scene.TopLine = true
+			} else {
+				scene.BottomLine = true
+			}
+			continue
+		case "text":
+			y := num(e, "y")
+			scene.FontSize = num(e, "font-size")
+			if y < scene.Height/2 {
+				scene.TopText, scene.MarginTop = e.Text, y-scene.FontSize
+			} else {
+				scene.BottomText, scene.MarginBottom = e.Text, scene.Height-y
+			}
+			continue
+		default:
+			return nil, errForeignSVG
+		}
+		scene.Shapes = append(scene.Shapes, shape)
+	}
+	if foreign || scene.Width <= 0 || scene.Height <= 0 {
+		return nil, errForeignSVG
+	}
+	scene.CurveStrength = strength
+	return scene, nil
+}
+
+// svgColor reads an SVG color as writeSVG writes it: rgb(r,g,b), white or
+// black.
+func svgColor(v string) (r, g, b int, ok bool) {
+	switch v {
+	case "white":
+		return 255, 255, 255, true
+	case "black":
+		return 0, 0, 0, true
+	}
+	if _, err := fmt.Sscanf(v, "rgb(%d,%d,%d)", &r, &g, &b); err != nil {
+		return 0, 0, 0, false
+	}
+	return r, g, b, true
+}
+
+// svgPoints reads a points attribute, setting foreign if it is malformed.
+func svgPoints(v string, foreign *bool) []Point {
+	var pts []Point
+	for _, xy := range strings.Fields(v) {
+		var p Point
+		if _, err := fmt.Sscanf(xy, "%d,%d", &p.X, &p.Y); err != nil {
+			*foreign = true
+		}
+		pts = append(pts, p)
+	}
+	return pts
+}
+
+// svgClip returns the clip id an element's clip-path attribute points to,
+// or 0.
+func svgClip(e svgElement) int {
+	v, _ := e.attr("clip-path")
+	id := 0
+	fmt.Sscanf(v, "url(#lr-clip-%d)", &id)
+	return id
+}
+
+// svgMarker returns the marker kind a marker-start or marker-end attribute
+// points to (see markerID), or "".
+func svgMarker(e svgElement, name string) string {
+	v, _ := e.attr(name)
+	id := strings.TrimSuffix(strings.TrimPrefix(v, "url(#lr-"), ")")
+	if id == v {
+		return ""
+	}
+	kind, _, _ := strings.Cut(id, "-")
+	return kind
+}
+
+// resizeImage scales img to w x h with bilinear filtering.
+func resizeImage(img image.Image, w, h int) *image.RGBA {
+	b := img.Bounds()
+	src := flatten(img, b.Dx(), b.Dy())
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	sx, sy := float64(b.Dx())/float64(w), float64(b.Dy())/float64(h)
+	for y := 0; y < h; y++ {
+		fy := math.Max((float64(y)+0.5)*sy-0.5, 0)
+		y0 := min(int(fy), b.Dy()-1)
+		y1, ty := min(y0+1, b.Dy()-1), fy-float64(y0)
+		for x := 0; x < w; x++ {
+			fx := math.Max((float64(x)+0.5)*sx-0.5, 0)
+			x0 := min(int(fx), b.Dx()-1)
+			x1, tx := min(x0+1, b.Dx()-1), fx-float64(x0)
+			for c := 0; c < 4; c++ {
+				at := func(x, y int) float64 { return float64(src.Pix[src.PixOffset(x, y)+c]) }
+				top := at(x0, y0)*(1-tx) + at(x1, y0)*tx
+				bottom := at(x0, y1)*(1-tx) + at(x1, y1)*tx
+				dst.Pix[dst.PixOffset(x, y)+c] = uint8(top*(1-ty) + bottom*ty + 0.5)
+			}
+		}
+	}
+	return dst
+}
+
+func decodeImage(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return img, nil
+}
+
+// imageDiff compares a and b, which have the same size, pixel by pixel
+// after flattening both onto white. A pixel is mismatched when its largest
+// channel difference is above tolerance. The heatmap shows a faded a with
+// mismatched pixels in red, stronger for bigger differences.
+func imageDiff(a, b image.Image, tolerance int) (heat *image.RGBA, mismatched, total, maxDiff int) {
+	w, h := a.Bounds().Dx(), a.Bounds().Dy()
+	fa, fb := flatten(a, w, h), flatten(b, w, h)
+	heat = image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(fa.Pix); i += 4 {
+		diff := 0
+		for c := 0; c < 3; c++ {
+			d := int(fa.Pix[i+c]) - int(fb.Pix[i+c])
+			if d < 0 {
+				d = -d
+			}
+			diff = max(diff, d)
+		}
+		maxDiff = max(maxDiff, diff)
+
+		lum := (299*int(fa.Pix[i]) + 587*int(fa.Pix[i+1]) + 114*int(fa.Pix[i+2])) / 1000
+		faded := uint8(255 - (255-lum)/4)
+		px := heat.Pix[i : i+4 : i+4]
+		px[0], px[1], px[2], px[3] = faded, faded, faded, 255
+		if diff > tolerance {
+			mismatched++
+			t := 0.4 + 0.6*float64(diff)/255
+			px[0] = uint8(float64(faded) + (255-float64(faded))*t + 0.5)
+			px[1] = uint8(float64(faded)*(1-t) + 0.5)
+			px[2] = uint8(float64(faded)*(1-t) + 0.5)
+		}
+	}
+	return heat, mismatched, w * h, maxDiff
+}
+
+// runPreview is the preview subcommand. It renders the file with the
+// built-in renderer and prints it to the terminal in 24-bit color, so a
+// drawing can be checked over SSH without copying an image around.
+func runPreview(args []string) int {
+	fs := flag.NewFlagSet("preview", flag.ExitOnError)
+	filepathFlag := fs.String("file", "", "Path to the .lrlogic file, or - to read stdin (required)")
+	cols := fs.Int("cols", 0, "Width in terminal columns (default the terminal width)")
+	mode := fs.String("mode", "blocks", "Characters to draw with: blocks (half blocks, two colors per cell) or braille (2x4 dots, one color per cell)")
+	verbose := fs.Bool("verbose", false, "Enable verbose output")
+	legacy := addLegacyFlag(fs)
+	fs.Parse(args)
+
+	if *filepathFlag == "" {
+		fmt.Println("Usage: lrlogic preview --file filename.lrlogic [--cols N] [--mode blocks|braille] [--verbose]")
+		return 1
+	}
+	if *mode != "blocks" && *mode != "braille" {
+		log.Printf("Unknown --mode %q, use blocks or braille", *mode)
+		return 1
+	}
+	if *cols == 0 {
+		*cols = terminalWidth()
+	}
+	if *cols < 1 {
+		log.Printf("Invalid --cols %d, must be greater than 0", *cols)
+		return 1
+	}
+
+	input := io.Reader(os.Stdin)
+	if *filepathFlag != "-" {
+		file, err := os.Open(*filepathFlag)
+		if err != nil {
+			log.Printf("Failed to open file: %v", err)
+			return 1
+		}
+		defer file.Close()
+		input = file
+	}
+	pages, err := parseLRLogic(input, *verbose, *legacy)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for i, scene := range pages {
+		if len(pages) > 1 {
+			fmt.Fprintf(out, "Page %d of %d\n", i+1, len(pages))
+		}
+		if *mode == "braille" {
+			writeBraille(out, scene, *cols)
+		} else {
+			writeBlocks(out, scene, *cols)
+		}
+	}
+	return 0
+}
+
+// terminalWidth returns the width of the terminal in columns, from
+// $COLUMNS or stty, or 80 when neither knows.
+func terminalWidth() int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
+	}
+	cmd := exec.Command("stty", "size")
+	cmd.Stdin = os.Stdin
+	if out, err := cmd.Output(); err == nil {
+		var rows, cols int
+		if _, err := fmt.Sscan(string(out), &rows, &cols); err == nil && cols > 0 {
+			return cols
+		}
+	}
+	return 80
+}
+
+// previewSamples is how many rendered pixels along each axis are merged
+// into one terminal pixel.
+const previewSamples = 4
+
+// previewImage renders scene w pixels wide for the terminal, onto white
+// when the background is transparent. Each pixel takes the color that
+// stands out most from the background among the ones it covers, so lines
+// much thinner than a character still show up in full color.
+func previewImage(scene *Scene, w int) (img *image.RGBA, bg color.RGBA) {
+	bg = color.RGBA{255, 255, 255, 255}
+	if !scene.Transparent {
+		bg = color.RGBA{uint8(scene.BgR), uint8(scene.BgG), uint8(scene.BgB), 255}
+	}
+	scale := float64(w) / float64(scene.Width)
+	big := renderImage(scene, scale*previewSamples)
+	fine := flatten(big, big.Bounds().Dx(), big.Bounds().Dy())
+	h := int(math.Ceil(float64(scene.Height) * scale))
+	img = image.NewRGBA(image.Rect(0, 0, w, max(h, 1)))
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < w; x++ {
+			best, bestDiff := bg, 0
+			for sy := y * previewSamples; sy < (y+1)*previewSamples && sy < fine.Bounds().Dy(); sy++ {
+				for sx := x * previewSamples; sx < (x+1)*previewSamples && sx < fine.Bounds().Dx(); sx++ {
+					c := fine.RGBAAt(sx, sy)
+					if d := colorDiff(c, bg); d > bestDiff {
+						best, bestDiff = c, d
+					}
+				}
+			}
+			img.SetRGBA(x, y, best)
+		}
+	}
+	return img, bg
+}
+
+// colorDiff returns the largest channel difference between a and b.
+func colorDiff(a, b color.RGBA) int {
+	d := 0
+	for _, c := range [][2]uint8{{a.R, b.R}, {a.G, b.G}, {a.B, b.B}} {
+		v := int(c[0]) - int(c[1])
+		if v < 0 {
+			v = -v
+		}
+		d = max(d, v)
+	}
+	return d
+}
+
+// ansiColors writes 24-bit ANSI color escapes, skipping the ones that
+// would repeat the colors already set.
+type ansiColors struct {
+	w      io.Writer
+	fg, bg *color.RGBA
+}
+
+func (a *ansiColors) set(fg, bg color.RGBA) {
+	if a.fg == nil || *a.fg != fg {
+		fmt.Fprintf(a.w, "\x1b[38;2;%d;%d;%dm", fg.R, fg.G, fg.B)
+		a.fg = &fg
+	}
+	if a.bg == nil || *a.bg != bg {
+		fmt.Fprintf(a.w, "\x1b[48;2;%d;%d;%dm", bg.R, bg.G, bg.B)
+		a.bg = &bg
+	}
+}
+
+// reset ends a line, so the background color doesn't run on to the edge
+// of the terminal.
+func (a *ansiColors) reset() {
+	io.WriteString(a.w, "\x1b[0m\n")
+	a.fg, a.bg = nil, nil
+}
+
+// writeBlocks prints scene cols characters wide with upper half blocks,
+// the top pixel in the foreground color and the bottom one in the
+// background color. Terminal cells are about twice as tall as wide, so the
+// pixels come out square.
+func writeBlocks(w io.Writer, scene *Scene, cols int) {
+	img, bg := previewImage(scene, cols)
+	h := img.Bounds().Dy()
+	ansi := &ansiColors{w: w}
+	for y := 0; y < h; y += 2 {
+		for x := 0; x < cols; x++ {
+			bottom := bg
+			if y+1 < h {
+				bottom = img.RGBAAt(x, y+1)
+			}
+			ansi.set(img.RGBAAt(x, y), bottom)
+			io.WriteString(w, "▀")
+		}
+		ansi.reset()
+	}
+}
+
+// brailleDots are the braille pattern bits of the dots in a 2x4 cell,
+// indexed by row and column.
+var brailleDots = [4][2]rune{{0x01, 0x08}, {0x02, 0x10}, {0x04, 0x20}, {0x40, 0x80}}
+
+// writeBraille prints scene cols characters wide with braille patterns,
+// 2x4 dots per character. A dot is set where the drawing differs from the
+// background, and each character takes the average color of its dots, so
+// it shows more detail than writeBlocks but only one color per cell.
+func writeBraille(w io.Writer, scene *Scene, cols int) {
+	img, bg := previewImage(scene, cols*2)
+	h := img.Bounds().Dy()
+	ansi := &ansiColors{w: w}
+	for y := 0; y < h; y += 4 {
+		for x := 0; x < cols; x++ {
+			dots := rune(0)
+			var r, g, b, n int
+			for dy := 0; dy < 4 && y+dy < h; dy++ {
+				for dx := 0; dx < 2; dx++ {
+					c := img.RGBAAt(2*x+dx, y+dy)
+					if colorDiff(c, bg) > 32 {
+						dots |= brailleDots[dy][dx]
+						r, g, b, n = r+int(c.R), g+int(c.G), b+int(c.B), n+1
+					}
+				}
+			}
+			fg := bg
+			if n > 0 {
+				fg = color.RGBA{uint8(r / n), uint8(g / n), uint8(b / n), 255}
+			}
+			ansi.set(fg, bg)
+			io.WriteString(w, string(0x2800+dots))
+		}
+		ansi.reset()
+	}
+}
+
+// easings map the tween --ease names to functions from linear progress
+// to eased progress, both from 0 to 1.
+var easings = map[string]func(float64) float64{
+	"linear": func(t float64) float64 { return t },
+	"in":     func(t float64) float64 { return t * t * t },
+	"out":    func(t float64) float64 { return 1 - (1-t)*(1-t)*(1-t) },
+	"inout": func(t float64) float64 {
+		if t < 0.5 {
+			return 4 * t * t * t
+		}
+		return 1 - 4*(1-t)*(1-t)*(1-t)
+	},
+}
+
+// runTween is the tween subcommand. It interpolates from the first page of
+// one file to the first page of another and writes the frames as a
+// numbered series of .lrlogic files, or, with --format or --emit, renders
+// them like the pages of one file, e.g. into a single animated GIF.
+func runTween(args []string) int {
+	fs := flag.NewFlagSet("tween", flag.ExitOnError)
+	frames := fs.Int("frames", 30, "Number of frames, counting the two files themselves")
+	ease := fs.String("ease", "linear", "Easing: linear, in, out or inout")
+	match := fs.String("match", "order", "Match primitives by order or by id (#name)")
+	name := fs.String("name", "", "Base name of the output files (default a_to_b)")
+	flags := addOutputFlags(fs)
+	inputs := parseArgs(fs, args)
+	if len(inputs) != 2 {
+		fmt.Println("Usage: lrlogic tween [--frames N] [--ease linear|in|out|inout] [--match order|id] [--name base] [--format gif] [output flags] a.lrlogic b.lrlogic")
+		return 1
+	}
+	easing, ok := easings[*ease]
+	if !ok {
+		log.Printf("Unknown --ease %q, use linear, in, out or inout", *ease)
+		return 1
+	}
+	if *match != "order" && *match != "id" {
+		log.Printf("Unknown --match %q, use order or id", *match)
+		return 1
+	}
+	if *frames < 2 {
+		log.Printf("Invalid --frames %d, must be at least 2", *frames)
+		return 1
+	}
+	opts, err := flags.options("gif")
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	var scenes [2]*Scene
+	for i, path := range inputs {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		pages, err := parseLRLogic(file, *flags.verbose, opts.LegacyFlip)
+		file.Close()
+		if err != nil {
+			log.Printf("%s: %v", path, err)
+			return 1
+		}
+		if len(pages) > 1 {
+			fmt.Printf("%s has %d pages, tweening the first\n", path, len(pages))
+		}
+		scenes[i] = pages[0]
+	}
+
+	base := *name
+	if base == "" {
+		stem := func(path string) string { return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)) }
+		base = stem(inputs[0]) + "_to_" + stem(inputs[1])
+	}
+	opts.SourceDir = filepath.Dir(inputs[0])
+
+	pages := make([]*Scene, *frames)
+	for i := range pages {
+		f := easing(float64(i) / float64(*frames-1))
+		pages[i] = tweenScene(scenes[0], scenes[1], f, *match == "id")
+	}
+
+	if *flags.format != "" || *flags.emit != "" {
+		err = writeOutputs(pages, base, opts)
+	} else {
+		err = writeSeries(pages, base, opts)
+	}
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	return 0
+}
+
+// writeSeries writes every page to its own .lrlogic file, numbered from 1
+// with leading zeros, so that --series reads them back in order.
+func writeSeries(pages []*Scene, base string, opts outputOptions) error {
+	width := max(3, len(strconv.Itoa(len(pages))))
+	used := make(map[string]bool)
+	var first, last string
+	for i, page := range pages {
+		path, err := opts.outputPath(fmt.Sprintf("%s_%0*d", base, width, i+1), "lrlogic", used)
+		if err != nil {
+			return err
+		}
+		err = writeFile(path, func(w io.Writer) error {
+			return writeLRLogic(w, []*Scene{page})
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to write %s: %v", path, err)
+		}
+		if i == 0 {
+			first = path
+		}
+		last = path
+	}
+	fmt.Printf("Generated %d frames, %s to %s\n", len(pages), first, last)
+	return nil
+}
+
+// tweenScene returns the frame a fraction f of the way from a to b.
+// Matched shapes move, resize and change color linearly in f; shapes
+// without a partner fade between their color and the background, out for
+// a's and in for b's, and are left out where they would be invisible.
+// Numbers of the scene itself are interpolated too, while text, fill,
+// stroke style, markers and stacking order switch over halfway. The frame
+// holds the clip regions of both scenes, b's after a's.
+func tweenScene(a, b *Scene, f float64, byID bool) *Scene {
+	lerp := func(x, y int) int { return int(math.Round(float64(x) + f*float64(y-x))) }
+	pick := a
+	if f >= 0.5 {
+		pick = b
+	}
+	frame := &Scene{
+		Width:         lerp(a.Width, b.Width),
+		Height:        lerp(a.Height, b.Height),
+		OutputWidth:   pick.OutputWidth,
+		OutputHeight:  pick.OutputHeight,
+		MarginTop:     lerp(a.MarginTop, b.MarginTop),
+		MarginBottom:  lerp(a.MarginBottom, b.MarginBottom),
+		FontSize:      lerp(a.FontSize, b.FontSize),
+		CurveStrength: lerp(a.CurveStrength, b.CurveStrength),
+		BgR:           lerp(a.BgR, b.BgR),
+		BgG:           lerp(a.BgG, b.BgG),
+		BgB:           lerp(a.BgB, b.BgB),
+		Transparent:   pick.Transparent,
+		TopText:       pick.TopText,
+		BottomText:    pick.BottomText,
+		TopLine:       pick.TopLine,
+		BottomLine:    pick.BottomLine,
+	}
+
+	offset := len(a.Clips)
+	bClip := func(id int) int {
+		if id == 0 {
+			return 0
+		}
+		return id + offset
+	}
+	frame.Clips = append([]ClipRegion{}, a.Clips...)
+	for _, region := range b.Clips {
+		region.Parent = bClip(region.Parent)
+		frame.Clips = append(frame.Clips, region)
+	}
+
+	// Faded shapes blend into the background; a transparent one is
+	// treated as white.
+	bgR, bgG, bgB := frame.BgR, frame.BgG, frame.BgB
+	if frame.Transparent {
+		bgR, bgG, bgB = 255, 255, 255
+	}
+	fade := func(sh Shape, t float64) Shape {
+		mix := func(c, bg int) int { return int(math.Round(float64(c) + t*float64(bg-c))) }
+		sh.R, sh.G, sh.B = mix(sh.R, bgR), mix(sh.G, bgG), mix(sh.B, bgB)
+		return sh
+	}
+
+	// Shapes are stacked in a's order up to halfway and in b's after,
+	// with the shapes only the other scene has on top.
+	pairs := matchShapes(a.Shapes, b.Shapes, byID)
+	if pick == b {
+		order := func(p [2]int) int {
+			if p[1] < 0 {
+				return len(b.Shapes) + p[0]
+			}
+			return p[1]
+		}
+		sort.SliceStable(pairs, func(x, y int) bool { return order(pairs[x]) < order(pairs[y]) })
+	}
+	for _, pair := range pairs {
+		i, j := pair[0], pair[1]
+		var sh Shape
+		switch {
+		case i >= 0 && j >= 0:
+			sa, sb := a.Shapes[i], b.Shapes[j]
+			sh = sa
+			if pick == b {
+				sh = sb
+				sh.Clip = bClip(sb.Clip)
+			}
+			sh.Points = make([]Point, len(sa.Points))
+			for k := range sa.Points {
+				sh.Points[k] = Point{lerp(sa.Points[k].X, sb.Points[k].X), lerp(sa.Points[k].Y, sb.Points[k].Y)}
+			}
+			sh.Size = lerp(sa.Size, sb.Size)
+			sh.R, sh.G, sh.B = lerp(sa.R, sb.R), lerp(sa.G, sb.G), lerp(sa.B, sb.B)
+		case i >= 0:
+			if f >= 1 {
+				continue
+			}
+			sh = fade(a.Shapes[i], f)
+		default:
+			if f <= 0 {
+				continue
+			}
+			sh = fade(b.Shapes[j], 1-f)
+			sh.Clip = bClip(sh.Clip)
+		}
+		sh.Keyframes = nil
+		frame.Shapes = append(frame.Shapes, sh)
+	}
+	return frame
+}
+
+// matchShapes pairs the shapes of a with those of b, returning index
+// pairs with -1 for a shape that has no partner: a's shapes in order,
+// then b's unmatched ones. Shapes pair up when they are of the same kind
+// and have as many points. With byID shapes that have an ID pair with the
+// shape with the same ID; all others pair up in order of appearance.
+func matchShapes(a, b []Shape, byID bool) [][2]int {
+	partner := make([]int, len(a))
+	taken := make([]bool, len(b))
+	fits := func(i, j int) bool {
+		return !taken[j] && a[i].Kind == b[j].Kind && len(a[i].Points) == len(b[j].Points)
+	}
+
+	if byID {
+		ids := make(map[string]int)
+		for j := len(b) - 1; j >= 0; j-- {
+			if b[j].ID != "" {
+				ids[b[j].ID] = j
+			}
+		}
+		for i := range a {
+			partner[i] = -1
+			if j, ok := ids[a[i].ID]; ok && a[i].ID != "" && fits(i, j) {
+				partner[i] = j
+				taken[j] = true
+			}
+		}
+	}
+	for i := range a {
+		if byID && a[i].ID != "" {
+			continue
+		}
+		partner[i] = -1
+		for j := range b {
+			if (!byID || b[j].ID == "") && fits(i, j) {
+				partner[i] = j
+				taken[j] = true
+				break
+			}
+		}
+	}
+
+	var pairs [][2]int
+	for i, j := range partner {
+		pairs = append(pairs, [2]int{i, j})
+	}
+	for j := range b {
+		if !taken[j] {
+			pairs = append(pairs, [2]int{-1, j})
+		}
+	}
+	return pairs
+}
+
+// sceneFile is the JSON document written by --emit json and read by
+// fromjson.
+type sceneFile struct {
+	Pages []*Scene `json:"pages"`
+}
+
+// writeJSON writes the pages as indented JSON.
+func writeJSON(w io.Writer, pages []*Scene) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sceneFile{Pages: pages})
+}
+
+// runFromJSON is the fromjson subcommand. It turns a scene written by
+// --emit json back into a .lrlogic file, then parses the result to check
+// that nothing was lost on the way.
+func runFromJSON(args []string) int {
+	fs := flag.NewFlagSet("fromjson", flag.ExitOnError)
+	out := fs.String("out", "", "Path of the .lrlogic file, or - for stdout (default {name}.lrlogic)")
+	force := fs.Bool("force", false, "Overwrite an existing output file")
+	inputs := parseArgs(fs, args)
+	if len(inputs) != 1 {
+		fmt.Println("Usage: lrlogic fromjson [--out file.lrlogic] [--force] scene.json")
+		return 1
+	}
+
+	input := io.Reader(os.Stdin)
+	name := "stdin"
+	if inputs[0] != "-" {
+		file, err := os.Open(inputs[0])
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		defer file.Close()
+		input = file
+		name = strings.TrimSuffix(filepath.Base(inputs[0]), filepath.Ext(inputs[0]))
+	}
+	var scene sceneFile
+	if err := json.NewDecoder(input).Decode(&scene); err != nil {
+		log.Printf("Invalid scene JSON: %v", err)
+		return 1
+	}
+	if len(scene.Pages) == 0 {
+		log.Print("Scene JSON has no pages")
+		return 1
+	}
+
+	var buf bytes.Buffer
+	if err := writeLRLogic(&buf, scene.Pages); err != nil {
+		log.Print(err)
+		return 1
+	}
+	if err := checkRoundTrip(buf.Bytes(), scene.Pages); err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	if *out == "-" {
+		os.Stdout.Write(buf.Bytes())
+		return 0
+	}
+	outName := *out
+	if outName == "" {
+		outName = name + ".lrlogic"
+	}
+	if _, err := os.Stat(outName); err == nil && !*force {
+		log.Printf("%s already exists, use --force to overwrite it", outName)
+		return 1
+	}
+	if err := os.WriteFile(outName, buf.Bytes(), 0644); err != nil {
+		log.Print(err)
+		return 1
+	}
+	fmt.Printf("Generated %s successfully.\n", outName)
+	return 0
+}
+
+// checkRoundTrip parses src and reports the first page that doesn't come
+// out the same as want.
+func checkRoundTrip(src []byte, want []*Scene) error {
+	got, err := parseLRLogic(bytes.NewReader(src), false, false)
+	if err != nil {
+		return err
+	}
+	if len(got) != len(want) {
+		return fmt.Errorf("the .lrlogic file has %d pages instead of %d", len(got), len(want))
+	}
+	for i := range want {
+		a, _ := json.Marshal(want[i])
+		b, _ := json.Marshal(got[i])
+		if !bytes.Equal(a, b) {
+			return fmt.Errorf("page %d can't be written exactly as .lrlogic, the file draws it differently", i+1)
+		}
+	}
+	return nil
+}
+
+// previewServer is the state behind lrlogic serve: the latest render of
+// the file and the diagnostics from parsing it.
+type previewServer struct {
+	path       string
+	verbose    bool
+	legacyFlip bool
+
+	mu      sync.Mutex
+	version int
+	pages   [][]byte      // SVG of each page from the last good parse
+	diags   []string      // parse error or skipped lines of the latest parse
+	changed chan struct{} // closed when a new version is ready
+}
+
+// runServe is the serve subcommand. It serves a page showing the rendered
+// file that reloads itself through server-sent events whenever the file
+// changes.
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	filepathFlag := fs.String("file", "", "Path to the .lrlogic file (required)")
+	addr := fs.String("addr", "127.0.0.1:8080", "Address to listen on")
+	verbose := fs.Bool("verbose", false, "Enable verbose output")
+	legacy := addLegacyFlag(fs)
+	fs.Parse(args)
+
+	if *filepathFlag == "" {
+		fmt.Println("Usage: lrlogic serve --file filename.lrlogic [--addr 127.0.0.1:8080] [--verbose]")
+		return 1
+	}
+
+	p := &previewServer{path: *filepathFlag, verbose: *verbose, legacyFlip: *legacy, changed: make(chan struct{})}
+	go pollFile(p.path, p.update)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", p.servePage)
+	mux.HandleFunc("/content", p.serveContent)
+	mux.HandleFunc("/page/", p.servePageSVG)
+	mux.HandleFunc("/events", p.serveEvents)
+	fmt.Fprintf(logOut, "Serving preview of %s at http://%s/\n", p.path, *addr)
+	if err := http.ListenAndServe(*addr, mux); err != nil {
+		log.Print(err)
+		return 1
+	}
+	return 0
+}
+
+// update parses the file again and tells the connected pages. When the
+// file does not parse the previous pages stay up under the error.
+func (p *previewServer) update() {
+	var diags []string
+	var svgs [][]byte
+	file, err := os.Open(p.path)
+	if err == nil {
+		var pages []*Scene
+		pages, err = parseLRLogic(file, p.verbose, p.legacyFlip)
+		file.Close()
+		diags = pageWarnings(pages)
+		for _, scene := range pages {
+			var svg bytes.Buffer
+			writeSVG(&svg, scene)
+			svgs = append(svgs, svg.Bytes())
+		}
+	}
+	if err != nil {
+		diags = []string{err.Error()}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		p.pages = svgs
+	}
+	p.diags = diags
+	p.version++
+	close(p.changed)
+	p.changed = make(chan struct{})
+	fmt.Fprintf(logOut, "Rendered %s, problems: %d\n", p.path, len(diags))
+}
+
+func (p *previewServer) servePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, previewPage, html.EscapeString(filepath.Base(p.path)))
+}
+
+// serveContent returns the diagnostics and pages as an HTML fragment for
+// the preview page to swap in. Every page is its own image, since the
+// clip and marker ids of one page's SVG would clash with the next one's
+// in a single document.
+func (p *previewServer) serveContent(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	pages, diags, version := len(p.pages), p.diags, p.version
+	p.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if len(diags) > 0 {
+		fmt.Fprintln(w, `<ul class="diags">`)
+		for _, d := range diags {
+			fmt.Fprintf(w, "<li>%s</li>\n", html.EscapeString(d))
+		}
+		fmt.Fprintln(w, "</ul>")
+	}
+	// The version keeps the browser from showing a cached page.
+	for i := 1; i <= pages; i++ {
+		fmt.Fprintf(w, `<img class="page" src="/page/%d.svg?v=%d" alt="Page %d">`+"\n", i, version, i)
+	}
+}
+
+// servePageSVG returns the SVG of one page, /page/N.svg with N counting
+// from 1.
+func (p *previewServer) servePageSVG(w http.ResponseWriter, r *http.Request) {
+	var n int
+	if _, err := fmt.Sscanf(r.URL.Path, "/page/%d.svg", &n); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	p.mu.Lock()
+	pages := p.pages
+	p.mu.Unlock()
+	if n < 1 || n > len(pages) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(pages[n-1])
+}
+
+// serveEvents streams the version number as a server-sent event now and
+// after every change, until the page goes away.
+func (p *previewServer) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	for {
+		p.mu.Lock()
+		version, changed := p.version, p.changed
+		p.mu.Unlock()
+		fmt.Fprintf(w, "data: %d\n\n", version)
+		flusher.Flush()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// previewPage is the page served by lrlogic serve, %s is the file name.
+const previewPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s - lrlogic preview</title>
+<style>
+body { font-family: sans-serif; background: #ddd; margin: 1em; }
+.diags { background: #fee; border: 1px solid #c00; color: #900; padding: 0.5em 2em; font-family: monospace; }
+img.page { display: block; margin: 1em 0; box-shadow: 0 0 4px #888; }
+</style>
+</head>
+<body>
+<div id="content"></div>
+<script>
+async function reload() {
+	const res = await fetch("/content");
+	document.getElementById("content").innerHTML = await res.text();
+}
+new EventSource("/events").onmessage = reload;
+</script>
+</body>
+</html>
+`
+
+// renderResult is the outcome of rendering one file in batch mode.
+type renderResult struct {
+	Path     string
+	Err      error
+	Duration time.Duration
+}
+
+// runRender is the render subcommand. It renders every file matching the
+// given paths or glob patterns in-process with a pool of --jobs workers.
+// A failed file is reported and does not stop the others; the exit code
+// is 1 if anything failed.
+func runRender(args []string) int {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	flags := addOutputFlags(fs)
+	jobs := fs.Int("jobs", runtime.NumCPU(), "Number of files to render at the same time")
+
+	patterns := parseArgs(fs, args)
+	if len(patterns) == 0 {
+		fmt.Println("Usage: lrlogic render [--jobs N] [output flags] 'pattern.lrlogic' ...")
+		return 1
+	}
+	if *jobs < 1 {
+		log.Printf("Invalid --jobs %d, must be at least 1", *jobs)
+		return 1
+	}
+	opts, err := flags.options("svg,jpg")
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	// Per file status lines from many workers would interleave, so they
+	// are only shown with --verbose and the summary below replaces them.
+	if !*flags.verbose {
+		logOut = io.Discard
+	}
+
+	files, failed := expandPatterns(patterns)
+	paths := make(chan string)
+	results := make(chan renderResult)
+	var wg sync.WaitGroup
+	for i := 0; i < *jobs && i < len(files); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				start := time.Now()
+				err := renderFile(path, opts, *flags.verbose)
+				results <- renderResult{Path: path, Err: err, Duration: time.Since(start)}
+			}
+		}()
+	}
+	go func() {
+		for _, path := range files {
+			paths <- path
+		}
+		close(paths)
+		wg.Wait()
+		close(results)
+	}()
+
+	start := time.Now()
+	rendered := 0
+	for r := range results {
+		if r.Err != nil {
+			fmt.Printf("FAILED %s: %v\n", r.Path, r.Err)
+			failed++
+			continue
+		}
+		fmt.Printf("OK     %s (%.2fs)\n", r.Path, r.Duration.Seconds())
+		rendered++
+	}
+	fmt.Printf("Rendered %d of %d files in %.2fs", rendered, rendered+failed, time.Since(start).Seconds())
+	if failed > 0 {
+		fmt.Printf(", %d failed\n", failed)
+		return 1
+	}
+	fmt.Println()
+	return 0
+}
+
+// parseArgs parses args with fs and returns the positional arguments.
+// Unlike fs.Parse, flags may also come after the first positional one.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// expandPatterns expands glob patterns into a sorted list of distinct
+// files. A pattern that matches nothing is reported and counted as a
+// failure; a plain path is passed through so the open error shows up in
+// the summary.
+func expandPatterns(patterns []string) (files []string, failed int) {
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			fmt.Printf("FAILED %s: %v\n", pattern, err)
+			failed++
+			continue
+		}
+		if len(matches) == 0 {
+			if !strings.ContainsAny(pattern, "*?[") {
+				matches = []string{pattern}
+			} else {
+				fmt.Printf("FAILED %s: no files match\n", pattern)
+				failed++
+				continue
+			}
+		}
+		sort.Strings(matches)
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				files = append(files, m)
+			}
+		}
+	}
+	return files, failed
+}
+
+// renderFile parses one .lrlogic file, prints its warnings and writes all
+// of its outputs.
+func renderFile(path string, opts outputOptions, verbose bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	pages, err := parseLRLogic(file, verbose, opts.LegacyFlip)
+	if err != nil {
+		return err
+	}
+	// Verbose mode already printed them while parsing.
+	if !verbose {
+		for _, w := range pageWarnings(pages) {
+			fmt.Fprintf(logOut, "%s: %s\n", path, w)
+		}
+	}
+	opts.SourceDir = filepath.Dir(path)
+	baseName := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	return writeOutputs(pages, baseName, opts)
+}
+
+// pageWarnings lists the Warnings of every page, prefixed with the page
+// number when there is more than one.
+func pageWarnings(pages []*Scene) []string {
+	var warnings []string
+	for i, scene := range pages {
+		for _, w := range scene.Warnings {
+			if len(pages) > 1 {
+				w = fmt.Sprintf("page %d, %s", i+1, w)
+			}
+			warnings = append(warnings, w)
+		}
+	}
+	return warnings
+}
+
+// writeStdout writes the single requested format to w. Only PDF, GIF and
+// JSON can hold more than one page, so other formats refuse multi-page
+// files.
+func writeStdout(w io.Writer, pages []*Scene, opts outputOptions) error {
+	pages = opts.resize(pages)
+	format := opts.Formats[0]
+	if format == "json" {
+		return writeJSON(w, pages)
+	}
+	if len(pages) > 1 && format != "pdf" && format != "gif" {
+		return fmt.Errorf("%s output to stdout holds a single page, file has %d", strings.ToUpper(format), len(pages))
+	}
+	switch {
+	case format == "svg":
+		writeSVG(w, pages[0])
+		return nil
+	case format == "pdf":
+		return writePDF(w, pages, opts.Page)
+	case format == "gif":
+		return writeGIF(w, pages, opts.Scale, opts.GIF)
+	case isVectorFormat(format):
+		return writeVector(format, w, pages[0], opts)
+	case !opts.External:
+		return writeRaster(format, w, renderImage(pages[0], opts.Scale*pages[0].pixelScale()), opts.Quality)
+	}
+
+	// The external converters only work on files, so go through temporary
+	// files and copy the result.
+	svgFile, err := os.CreateTemp("", "lrlogic-*.svg")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(svgFile.Name())
+	writeSVG(svgFile, pages[0])
+	if err := svgFile.Close(); err != nil {
+		return err
+	}
+	outName := strings.TrimSuffix(svgFile.Name(), ".svg") + "." + format
+	defer os.Remove(outName)
+	if err := convertExternal(format, svgFile.Name(), outName, opts.Scale); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(outName)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// outputOptions are the command line settings that control what gets
+// written for a parsed file.
+type outputOptions struct {
+	Formats    []string
+	Quality    int
+	Scale      float64
+	Width      int // --width and --height, 0 if not given
+	Height     int
+	Page       string
+	Units      string
+	Plot       plotOptions
+	GIF        gifOptions
+	External   bool
+	Out        string
+	OutDir     string
+	Force      bool
+	SourceDir  string
+	Responsive bool
+	LegacyFlip bool // --legacy-flip, for parseLRLogic
+}
+
+// writeOutputs writes every requested format for a parsed file. Multi-page
+// formats (PDF, GIF) get all pages in baseName.ext; single-page formats get one
+// file per page, with pages after the first named baseName-N.ext.
+func writeOutputs(pages []*Scene, baseName string, opts outputOptions) error {
+	pages = opts.resize(pages)
+	used := make(map[string]bool)
+	for i, scene := range pages {
+		name := baseName
+		if i > 0 {
+			name = fmt.Sprintf("%s-%d", baseName, i+1)
+		}
+		if err := writePageOutputs(scene, name, opts, used); err != nil {
+			return err
+		}
+	}
+
+	// PDF, GIF and JSON hold every page in one file.
+	for _, format := range opts.Formats {
+		if format != "pdf" && format != "gif" && format != "json" {
+			continue
+		}
+		outName, err := opts.outputPath(baseName, format, used)
+		if err != nil {
+			return err
+		}
+		err = writeFile(outName, func(w io.Writer) error {
+			switch format {
+			case "json":
+				return writeJSON(w, pages)
+			case "gif":
+				return writeGIF(w, pages, opts.Scale, opts.GIF)
+			}
+			return writePDF(w, pages, opts.Page)
+		})
+		if err != nil {
+			return fmt.Errorf("%s export failed with error: %v", strings.ToUpper(format), err)
+		}
+		fmt.Fprintf(logOut, "Generated %s successfully.\n", outName)
+	}
+	return nil
+}
+
+// writePageOutputs writes the single-page formats for one scene.
+func writePageOutputs(scene *Scene, baseName string, opts outputOptions, used map[string]bool) error {
+	// The built-in renderer works from the scene. An external converter
+	// needs the SVG on disk, so it gets a temporary copy when SVG output
+	// was not asked for.
+	svgName := ""
+	needSVG := false
+	for _, format := range opts.Formats {
+		if format == "svg" {
+			name, err := opts.outputPath(baseName, "svg", used)
+			if err != nil {
+				return err
+			}
+			svgName = name
+		} else if opts.External && isRasterFormat(format) {
+			needSVG = true
+		}
+	}
+	if svgName != "" {
+		output, err := os.Create(svgName)
+		if err != nil {
+			return fmt.Errorf("Failed to create %s: %v", svgName, err)
+		}
+		writeSVG(output, scene)
+		if err := output.Close(); err != nil {
+			return fmt.Errorf("Failed to write %s: %v", svgName, err)
+		}
+		fmt.Fprintf(logOut, "Generated %s successfully\n", svgName)
+	} else if needSVG {
+		tmp, err := os.CreateTemp("", "lrlogic-*.svg")
+		if err != nil {
+			return fmt.Errorf("Failed to create temporary SVG: %v", err)
+		}
+		defer os.Remove(tmp.Name())
+		writeSVG(tmp, scene)
+		if err := tmp.Close(); err != nil {
+			return fmt.Errorf("Failed to write temporary SVG: %v", err)
+		}
+		svgName = tmp.Name()
+	}
+
+	for _, format := range opts.Formats {
+		if !isVectorFormat(format) {
+			continue
+		}
+		outName, err := opts.outputPath(baseName, format, used)
+		if err != nil {
+			return err
+		}
+		err = writeFile(outName, func(w io.Writer) error {
+			return writeVector(format, w, scene, opts)
+		})
+		if err != nil {
+			return fmt.Errorf("%s export failed with error: %v", strings.ToUpper(format), err)
+		}
+		fmt.Fprintf(logOut, "Generated %s successfully.\n", outName)
+	}
+
+	var img *image.RGBA
+	for _, format := range opts.Formats {
+		if !isRasterFormat(format) {
+			continue
+		}
+		outName, err := opts.outputPath(baseName, format, used)
+		if err != nil {
+			return err
+		}
+		if opts.External {
+			err = convertExternal(format, svgName, outName, opts.Scale)
+		} else {
+			if img == nil {
+				img = renderImage(scene, opts.Scale*scene.pixelScale())
+			}
+			err = writeFile(outName, func(w io.Writer) error {
+				return writeRaster(format, w, img, opts.Quality)
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("%s conversion failed with error: %v", strings.ToUpper(format), err)
+		}
+		fmt.Fprintf(logOut, "Generated %s successfully.\n", outName)
+	}
+	return nil
+}
+
+// outputPath returns where the output for name in format ext goes. --out is
+// a template with {name} (the input's base name, with -N for later pages),
+// {ext} (the format) and {dir} (the input's directory), joined onto --outdir
+// which may use the same placeholders. Missing directories are created.
+// When --out or --outdir is given an existing file is only replaced with
+// --force. used holds the paths already written in this run so two outputs
+// never land on the same file.
+func (o outputOptions) outputPath(name, ext string, used map[string]bool) (string, error) {
+	dir := o.SourceDir
+	if dir == "" {
+		dir = "."
+	}
+	expand := strings.NewReplacer("{name}", name, "{ext}", ext, "{dir}", dir).Replace
+
+	pattern := o.Out
+	if pattern == "" {
+		pattern = "{name}.{ext}"
+	}
+	path := expand(pattern)
+	if o.OutDir != "" {
+		path = filepath.Join(expand(o.OutDir), path)
+	}
+	path = filepath.Clean(path)
+
+	if used[path] {
+		return "", fmt.Errorf("Output path %s is used more than once, add {name} or {ext} to --out", path)
+	}
+	used[path] = true
+
+	if o.Out == "" && o.OutDir == "" {
+		return path, nil
+	}
+	if parent := filepath.Dir(path); parent != "." {
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return "", fmt.Errorf("Failed to create output directory %s: %v", parent, err)
+		}
+	}
+	if !o.Force {
+		if _, err := os.Stat(path); err == nil {
+			return "", fmt.Errorf("Refusing to overwrite %s, use --force to replace it", path)
+		}
+	}
+	return path, nil
+}
+
+// parseFormats turns the --format list into an ordered list of distinct
+// output formats. Without --format the output is svg and jpg, as it was
+// before --format existed; --nojpg and --nosvg drop those formats either way.
+func parseFormats(list string, nojpg, nosvg bool) ([]string, error) {
+	if list == "" {
+		list = "svg,jpg"
+	}
+	var formats []string
+	seen := make(map[string]bool)
+	for _, f := range strings.Split(list, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "jpeg" {
+			f = "jpg"
+		}
+		switch f {
+		case "svg", "png", "jpg", "pdf", "gif", "eps", "dxf", "gcode", "hpgl":
+		case "":
+			continue
+		default:
+			return nil, fmt.Errorf("Unknown output format %q", f)
+		}
+		if (f == "jpg" && nojpg) || (f == "svg" && nosvg) || seen[f] {
+			continue
+		}
+		seen[f] = true
+		formats = append(formats, f)
+	}
+	if len(formats) == 0 {
+		return nil, errors.New("No output formats selected")
+	}
+	return formats, nil
+}
+
+func isRasterFormat(format string) bool {
+	return format == "png" || format == "jpg"
+}
+
+// isVectorFormat reports the formats besides SVG and PDF that are written
+// one file per page straight from the scene.
+func isVectorFormat(format string) bool {
+	return format == "eps" || format == "dxf" || format == "gcode" || format == "hpgl"
+}
+
+func writeVector(format string, w io.Writer, scene *Scene, opts outputOptions) error {
+	switch format {
+	case "eps":
+		return writeEPS(w, scene)
+	case "dxf":
+		return writeDXF(w, scene, opts.Units, opts.Plot.Optimize)
+	case "gcode":
+		return writeGCode(w, scene, opts.Plot)
+	case "hpgl":
+		return writeHPGL(w, scene, opts.Plot)
+	}
+	return fmt.Errorf("%s is not a vector format", format)
+}
+
+// writeRaster encodes an image rendered by renderImage. PNG keeps
+// transparency.
+func writeRaster(format string, w io.Writer, img image.Image, quality int) error {
+	switch format {
+	case "png":
+		return png.Encode(w, img)
+	case "jpg":
+		return writeJPG(w, img, quality)
+	}
+	return fmt.Errorf("%s is not a raster format", format)
+}
+
+// convertExternal converts the SVG file with rsvg-convert or ImageMagick.
+// JPG has no alpha channel so a transparent background is flattened onto
+// white there.
+func convertExternal(format, svgName, outName string, scale float64) error {
+	if checkCommand("rsvg-convert") {
+		args := []string{"-z", strconv.FormatFloat(scale, 'f', -1, 64), "-o", outName}
+		if format == "jpg" {
+			args = append(args, "-b", "white")
+		}
+		return exec.Command("rsvg-convert", append(args, svgName)...).Run()
+	}
+	if checkCommand("convert") {
+		density := strconv.FormatFloat(96*scale, 'f', -1, 64)
+		args := []string{"-density", density, "-background", "none", svgName}
+		if format == "jpg" {
+			args = []string{"-density", density, "-background", "white", svgName, "-flatten"}
+		}
+		return exec.Command("convert", append(args, outName)...).Run()
+	}
+	return errors.New("No rsvg-convert binary found!")
+}
+
+// origin is where 0,0 of the file coordinates is (see LRORIGIN). Scenes
+// always use SVG coordinates with 0,0 at the top left and y pointing down.
+type origin int
+
+const (
+	originTopLeft    origin = iota // y down, like SVG (V1 default)
+	originBottomLeft               // y up (V2 default)
+	originCenter                   // y up, 0,0 in the middle of the canvas
+)
+
+var origins = map[string]origin{
+	"TOPLEFT":    originTopLeft,
+	"BOTTOMLEFT": originBottomLeft,
+	"CENTER":     originCenter,
+}
+
+// viewBox is the area of file coordinates a canvas shows, set by LRVIEWBOX.
+// X, Y is the corner nearest the origin, so the bottom left one when y
+// points up.
+type viewBox struct {
+	X, Y, W, H int
+}
+
+// canvasBox returns the view of a width x height canvas without LRVIEWBOX:
+// the canvas starting at 0,0, or around it for CENTER.
+func (o origin) canvasBox(width, height int) viewBox {
+	if o == originCenter {
+		return viewBox{-width / 2, -height / 2, width, height}
+	}
+	return viewBox{0, 0, width, height}
+}
+
+// point converts file coordinates in box to scene coordinates, which start
+// at the box's top left corner.
+func (o origin) point(x, y int, box viewBox) Point {
+	if o == originTopLeft {
+		return Point{x - box.X, y - box.Y}
+	}
+	return Point{x - box.X, box.Y + box.H - y}
+}
+
+// corner converts the x, y of a square or clip rectangle that is h high
+// to the scene's top left corner. With y pointing up, x, y is the bottom
+// left corner.
+func (o origin) corner(x, y, h int, box viewBox) Point {
+	p := o.point(x, y, box)
+	if o != originTopLeft {
+		p.Y -= h
+	}
+	return p
+}
+
+// parseLRLogic reads a V1 or V2 .lrlogic file into one Scene per page (see
+// LRPAGE). Malformed lines are skipped and listed in the Warnings of their
+// page (and reported when verbose is set); only a missing or unknown header
+// is an error. legacyFlip puts 0,0 of V1 files at the bottom left like V2
+// (--legacy-flip), as lrlogic did before LRORIGIN.
+func parseLRLogic(r io.Reader, verbose, legacyFlip bool) ([]*Scene, error) {
+	scanner := bufio.NewScanner(r)
+
+	// Detect file version
+	if !scanner.Scan() {
+		return nil, errors.New("File is empty!")
+	}
+	header := scanner.Text()
+	isV2 := false
+	if header == "LRFILE VERSION 2" {
+		isV2 = true
+		if verbose {
+			fmt.Fprintln(logOut, "Detected LRFILE VERSION 2")
+		}
+	} else if header == "LRLOGIC FILE FORMAT V1" {
+		isV2 = false
+		if verbose {
+			fmt.Fprintln(logOut, "Detected LRLOGIC FILE FORMAT V1")
+		}
+	} else {
+		return nil, errors.New("Invalid file header!")
+	}
+
+	// Defaults
+	width := 640
+	height := 480
+	marginTop := 20
+	marginBottom := 20
+	fontSize := 16
+	curveStrength := 5
+	bgR, bgG, bgB := 255, 255, 255
+	transparent := false
+
+	var shapes []Shape
+	var topText, bottomText string
+	var topLine, bottomLine bool
+	var coloredLines []ColoredLine
+	var strokeStyle StrokeStyle
+	var clipRegions []ClipRegion // clip id n is clipRegions[n-1]
+	var clipStack []int
+	currentClip := 0
+	var pages []*Scene
+	var warnings []string
+	duration, repeat := 0.0, 0
+	// LRANIMATE keys go to the last circle or square (shapes index) or
+	// line (coloredLines index) drawn, whichever is not -1.
+	animShape, animLine := -1, -1
+
+	// V1 files put 0,0 at the top left and V2 files at the bottom left,
+	// unless LRORIGIN says otherwise.
+	orig := originTopLeft
+	if isV2 || legacyFlip {
+		orig = originBottomLeft
+	}
+	// Coordinates are read relative to box(): the LRVIEWBOX, if any, or
+	// the canvas.
+	var view *viewBox
+	box := func() viewBox {
+		if view != nil {
+			return *view
+		}
+		return orig.canvasBox(width, height)
+	}
+
+	// Fill mode logic:
+	fillMode := true // default fill mode
+	if isV2 {
+		fillMode = false // for v2 start off with no fill until LRFILL ON is encountered
+	}
+
+	finishPage := func() {
+		// With a view the drawing is view-sized and the canvas size
+		// becomes the size to scale it to.
+		w, h, outW, outH := width, height, 0, 0
+		if view != nil {
+			w, h, outW, outH = view.W, view.H, width, height
+		}
+		pages = append(pages, &Scene{
+			Width:         w,
+			Height:        h,
+			OutputWidth:   outW,
+			OutputHeight:  outH,
+			MarginTop:     marginTop,
+			MarginBottom:  marginBottom,
+			FontSize:      fontSize,
+			CurveStrength: curveStrength,
+			BgR:           bgR,
+			BgG:           bgG,
+			BgB:           bgB,
+			Transparent:   transparent,
+			TopText:       topText,
+			BottomText:    bottomText,
+			TopLine:       topLine,
+			BottomLine:    bottomLine,
+			Shapes:        append(shapes, groupLines(coloredLines, isV2, fillMode)...),
+			Clips:         clipRegions,
+			Duration:      duration,
+			Repeat:        repeat,
+			Warnings:      warnings,
+		})
+	}
+
+	lineNum := 1 // counting from line after header
+	warn := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		warnings = append(warnings, fmt.Sprintf("line %d: %s", lineNum, msg))
+		if verbose {
+			fmt.Fprintln(logOut, msg)
+		}
+	}
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if verbose {
+			fmt.Fprintf(logOut, "Processing line %d: %s\n", lineNum, line)
+		}
+
+		if line == "LREXIT" {
+			if verbose {
+				fmt.Fprintln(logOut, "Found LREXIT, stopping parse.")
+			}
+			break
+		}
+
+		if line == "LRPAGE" {
+			// Start a new canvas. Settings carry over, drawn content,
+			// text and clip blocks do not.
+			finishPage()
+			shapes, coloredLines, clipRegions, clipStack, warnings = nil, nil, nil, nil, nil
+			currentClip = 0
+			animShape, animLine = -1, -1
+			topText, bottomText = "", ""
+			topLine, bottomLine = false, false
+			if verbose {
+				fmt.Fprintf(logOut, "Started page %d\n", len(pages)+1)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "LRRESDEFINEX") {
+			parts := strings.Fields(line)
+			if len(parts) == 2 {
+				if val, err := strconv.Atoi(parts[1]); err == nil {
+					width = val
+					if verbose {
+						fmt.Fprintf(logOut, "Set width to %d\n", width)
+					}
+				}
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "LRRESDEFINEY") {
+			parts := strings.Fields(line)
+			if len(parts) == 2 {
+				if val, err := strconv.Atoi(parts[1]); err == nil {
+					height = val
+					if verbose {
+						fmt.Fprintf(logOut, "Set height to %d\n", height)
+					}
+				}
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "LRVIEWBOX") {
+			// Format: LRVIEWBOX x,y,w,h | OFF
+			parts := strings.Fields(line)
+			if len(parts) == 2 && parts[1] == "OFF" {
+				view = nil
+				if verbose {
+					fmt.Fprintln(logOut, "Removed view box")
+				}
+				continue
+			}
+			var vals []int
+			if len(parts) == 2 {
+				for _, v := range strings.Split(parts[1], ",") {
+					n, err := strconv.Atoi(v)
+					if err != nil {
+						vals = nil
+						break
+					}
+					vals = append(vals, n)
+				}
+			}
+			if len(vals) != 4 || vals[2] <= 0 || vals[3] <= 0 {
+				warn("Skipping malformed LRVIEWBOX line: %s", line)
+				continue
+			}
+			view = &viewBox{vals[0], vals[1], vals[2], vals[3]}
+			if verbose {
+				fmt.Fprintf(logOut, "Set view box to %d,%d size %dx%d\n", view.X, view.Y, view.W, view.H)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "LRMARGIN") {
+			parts := strings.Fields(line)
+			if len(parts) == 3 {
+				if val, err := strconv.Atoi(parts[1]); err == nil {
+					marginTop = val
+					if verbose {
+						fmt.Fprintf(logOut, "Set marginTop to %d\n", marginTop)
+					}
+				}
+				if val, err := strconv.Atoi(parts[2]); err == nil {
+					marginBottom = val
+					if verbose {
+						fmt.Fprintf(logOut, "Set marginBottom to %d\n", marginBottom)
+					}
+				}
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "LRFONTSIZE") {
+			parts := strings.Fields(line)
+			if len(parts) == 2 {
+				if val, err := strconv.Atoi(parts[1]); err == nil {
+					fontSize = val
+					if verbose {
+						fmt.Fprintf(logOut, "Set fontSize to %d\n", fontSize)
+					}
+				}
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "LRCURVE") {
+			parts := strings.Fields(line)
+			if len(parts) == 2 {
+				if val, err := strconv.Atoi(parts[1]); err == nil {
+					curveStrength = val
+					if verbose {
+						fmt.Fprintf(logOut, "Set curveStrength to %d\n", curveStrength)
+					}
+				}
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "LRORIGIN") {
+			// Format: LRORIGIN TOPLEFT|BOTTOMLEFT|CENTER
+			parts := strings.Fields(line)
+			o, ok := origin(0), false
+			if len(parts) == 2 {
+				o, ok = origins[strings.ToUpper(parts[1])]
+			}
+			if !ok {
+				warn("Skipping malformed LRORIGIN line: %s", line)
+				continue
+			}
+			orig = o
+			if verbose {
+				fmt.Fprintf(logOut, "Set origin to %s\n", strings.ToUpper(parts[1]))
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "LRCLIP") {
+			// Format: LRCLIP RECT x,y,w,h | CIRCLE x,y,r | POLY x1,y1,x2,y2,... | MARGIN | END
+			parts := strings.Fields(line)
+			if len(parts) < 2 {
+				warn("Skipping malformed LRCLIP line")
+				continue
+			}
+			kind := strings.ToUpper(parts[1])
+			if kind == "END" {
+				if len(clipStack) == 0 {
+					warn("Skipping LRCLIP END without an open clip block")
+					continue
+				}
+				clipStack = clipStack[:len(clipStack)-1]
+				currentClip = 0
+				if len(clipStack) > 0 {
+					currentClip = clipStack[len(clipStack)-1]
+				}
+				if verbose {
+					fmt.Fprintln(logOut, "Closed clip block")
+				}
+				continue
+			}
+
+			var vals []int
+			if len(parts) == 3 {
+				for _, v := range strings.Split(parts[2], ",") {
+					n, err := strconv.Atoi(v)
+					if err != nil {
+						vals = nil
+						break
+					}
+					vals = append(vals, n)
+				}
+			}
+
+			region := ClipRegion{Kind: strings.ToLower(kind), Parent: currentClip}
+			valid := true
+			switch kind {
+			case "RECT":
+				if len(vals) != 4 {
+					valid = false
+					break
+				}
+				p := orig.corner(vals[0], vals[1], vals[3], box()) // like LRSQUARE
+				region.X, region.Y, region.W, region.H = p.X, p.Y, vals[2], vals[3]
+			case "CIRCLE":
+				if len(vals) != 3 {
+					valid = false
+					break
+				}
+				p := orig.point(vals[0], vals[1], box())
+				region.X, region.Y, region.R = p.X, p.Y, vals[2]
+			case "POLY":
+				if len(vals) < 6 || len(vals)%2 != 0 {
+					valid = false
+					break
+				}
+				for i := 0; i < len(vals); i += 2 {
+					region.Points = append(region.Points, orig.point(vals[i], vals[i+1], box()))
+				}
+			case "MARGIN":
+				valid = len(parts) == 2
+			default:
+				valid = false
+			}
+			if !valid {
+				warn("Skipping malformed LRCLIP line: %s", line)
+				continue
+			}
+
+			clipRegions = append(clipRegions, region)
+			currentClip = len(clipRegions)
+			clipStack = append(clipStack, currentClip)
+			if verbose {
+				fmt.Fprintf(logOut, "Opened %s clip block %d\n", region.Kind, currentClip)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "LRBACKGROUND") {
+			// Format: LRBACKGROUND r,g,b or LRBACKGROUND NONE
+			parts := strings.Fields(line)
+			if len(parts) != 2 {
+				warn("Skipping malformed LRBACKGROUND line")
+				continue
+			}
+			if strings.ToUpper(parts[1]) == "NONE" {
+				transparent = true
+				if verbose {
+					fmt.Fprintln(logOut, "Set background to transparent")
+				}
+				continue
+			}
+			rgbParts := strings.Split(parts[1], ",")
+			if len(rgbParts) == 3 {
+				r, errR := strconv.Atoi(rgbParts[0])
+				g, errG := strconv.Atoi(rgbParts[1])
+				b, errB := strconv.Atoi(rgbParts[2])
+				if errR == nil && errG == nil && errB == nil {
+					bgR, bgG, bgB = r, g, b
+					transparent = false
+					if verbose {
+						fmt.Fprintf(logOut, "Set background to rgb(%d,%d,%d)\n", r, g, b)
+					}
+					continue
+				}
+			}
+			warn("Skipping malformed LRBACKGROUND color: %s", parts[1])
+			continue
+		}
+
+		if strings.HasPrefix(line, "LRTXT.Top") {
+			topText = extractText(line)
+			topLine = true
+			if verbose {
+				fmt.Fprintf(logOut, "Set topText: %s\n", topText)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "LRTXT.Bottom") {
+			bottomText = extractText(line)
+			bottomLine = true
+			if verbose {
+				fmt.Fprintf(logOut, "Set bottomText: %s\n", bottomText)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "LRFILL") && isV2 {
+			parts := strings.Fields(line)
+			if len(parts) == 2 {
+				val := strings.ToUpper(parts[1])
+				if val == "ON" {
+					fillMode = true
+					if verbose {
+						fmt.Fprintln(logOut, "Fill mode enabled")
+					}
+				} else if val == "OFF" {
+					fillMode = false
+					if verbose {
+						fmt.Fprintln(logOut, "Fill mode disabled")
+					}
+				}
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "LRDASH") {
+			// Format: LRDASH dash,gap[,dash,gap...] or LRDASH OFF
+			parts := strings.Fields(line)
+			if len(parts) != 2 {
+				warn("Skipping malformed LRDASH line")
+				continue
+			}
+			if strings.ToUpper(parts[1]) == "OFF" {
+				strokeStyle.Dash = nil
+				if verbose {
+					fmt.Fprintln(logOut, "Dash pattern disabled")
+				}
+				continue
+			}
+			var dash []int
+			valid := true
+			total := 0
+			for _, v := range strings.Split(parts[1], ",") {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 0 {
+					valid = false
+					break
+				}
+				dash = append(dash, n)
+				total += n
+			}
+			if !valid {
+				warn("Skipping malformed LRDASH pattern: %s", parts[1])
+				continue
+			}
+			if total == 0 {
+				warn("Skipping LRDASH pattern without any length: %s", parts[1])
+				continue
+			}
+			strokeStyle.Dash = dash
+			if verbose {
+				fmt.Fprintf(logOut, "Set dash pattern to %v\n", dash)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "LRCAP") {
+			// DEFAULT goes back to leaving the line cap to the output format.
+			parts := strings.Fields(line)
+			if len(parts) == 2 {
+				val := strings.ToLower(parts[1])
+				if val == "default" {
+					strokeStyle.Cap = ""
+					if verbose {
+						fmt.Fprintln(logOut, "Reset line cap to the default")
+					}
+				} else if val == "butt" || val == "round" || val == "square" {
+					strokeStyle.Cap = val
+					if verbose {
+						fmt.Fprintf(logOut, "Set line cap to %s\n", val)
+					}
+				} else {
+					warn("Skipping unknown LRCAP value: %s", parts[1])
+				}
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "LRJOIN") {
+			// DEFAULT goes back to leaving the line join to the output format.
+			parts := strings.Fields(line)
+			if len(parts) == 2 {
+				val := strings.ToLower(parts[1])
+				if val == "default" {
+					strokeStyle.Join = ""
+					if verbose {
+						fmt.Fprintln(logOut, "Reset line join to the default")
+					}
+				} else if val == "miter" || val == "round" || val == "bevel" {
+					strokeStyle.Join = val
+					if verbose {
+						fmt.Fprintf(logOut, "Set line join to %s\n", val)
+					}
+				} else {
+					warn("Skipping unknown LRJOIN value: %s", parts[1])
+				}
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "LRDURATION") {
+			// Format: LRDURATION seconds, 0 to end at the last keyframe
+			parts := strings.Fields(line)
+			if len(parts) != 2 {
+				warn("Skipping malformed LRDURATION line")
+				continue
+			}
+			val, err := strconv.ParseFloat(parts[1], 64)
+			if err != nil || val < 0 {
+				warn("Skipping invalid LRDURATION: %s", parts[1])
+				continue
+			}
+			duration = val
+			if verbose {
+				fmt.Fprintf(logOut, "Set animation duration to %gs\n", duration)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "LRLOOP") {
+			// Format: LRLOOP ON | OFF | count
+			parts := strings.Fields(line)
+			if len(parts) != 2 {
+				warn("Skipping malformed LRLOOP line")
+				continue
+			}
+			switch val := strings.ToUpper(parts[1]); val {
+			case "ON":
+				repeat = 0
+			case "OFF":
+				repeat = 1
+			default:
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 1 {
+					warn("Skipping invalid LRLOOP value: %s", parts[1])
+					continue
+				}
+				repeat = n
+			}
+			if verbose {
+				fmt.Fprintf(logOut, "Set animation repeat count to %d (0 loops forever)\n", repeat)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "LRANIMATE") {
+			// Format: LRANIMATE t x,y,r..r,g,b after a circle, LRANIMATE t
+			// x,y,size..r,g,b after a square or LRANIMATE t
+			// x1,y1,x2,y2..r,g,b after a line. Without a color the one of
+			// the key before is kept.
+			parts := strings.Fields(line)
+			if len(parts) != 3 {
+				warn("Skipping malformed LRANIMATE line")
+				continue
+			}
+			t, err := strconv.ParseFloat(parts[1], 64)
+			if err != nil || t <= 0 {
+				warn("Skipping LRANIMATE with invalid time: %s", parts[1])
+				continue
+			}
+			var keys *[]Keyframe
+			var kind string
+			var r, g, b int
+			switch {
+			case animShape >= 0:
+				sh := &shapes[animShape]
+				keys, kind, r, g, b = &sh.Keyframes, sh.Kind, sh.R, sh.G, sh.B
+			case animLine >= 0:
+				l := &coloredLines[animLine]
+				keys, kind, r, g, b = &l.Keyframes, "line", l.R, l.G, l.B
+			default:
+				warn("Skipping LRANIMATE without a circle, square or line before it")
+				continue
+			}
+			if n := len(*keys); n > 0 {
+				last := (*keys)[n-1]
+				if t <= last.Time {
+					warn("Skipping LRANIMATE at %s, keyframes must be in time order", parts[1])
+					continue
+				}
+				r, g, b = last.R, last.G, last.B
+			}
+			key, ok := parseKeyframe(parts[2], kind, orig, box(), r, g, b)
+			if !ok {
+				warn("Skipping malformed LRANIMATE values for a %s: %s", kind, parts[2])
+				continue
+			}
+			key.Time = t
+			*keys = append(*keys, key)
+			if verbose {
+				fmt.Fprintf(logOut, "Added %s keyframe at %gs\n", kind, t)
+			}
+			continue
+		}
+
+		// Handle circles and squares for v2
+		if isV2 && strings.HasPrefix(line, "LRCIRCLE") {
+			// Format: LRCIRCLE x,y,radius..r,g,b [#id]
+			id, line := cutID(line)
+			parts := strings.SplitN(line, " ", 2)
+			if len(parts) < 2 {
+				warn("Skipping malformed LRCIRCLE line")
+				continue
+			}
+			params := parts[1]
+			colorR, colorG, colorB := 0, 0, 0
+			if strings.Contains(params, "..") {
+				subparts := strings.Split(params, "..")
+				params = subparts[0]
+				rgbParts := strings.Split(subparts[1], ",")
+				if len(rgbParts) == 3 {
+					colorR, _ = strconv.Atoi(rgbParts[0])
+					colorG, _ = strconv.Atoi(rgbParts[1])
+					colorB, _ = strconv.Atoi(rgbParts[2])
+				}
+			}
+			vals := strings.Split(params, ",")
+			if len(vals) != 3 {
+				warn("Skipping malformed LRCIRCLE parameters")
+				continue
+			}
+			x, _ := strconv.Atoi(vals[0])
+			y, _ := strconv.Atoi(vals[1])
+			radius, _ := strconv.Atoi(vals[2])
+			p := orig.point(x, y, box())
+			x, y = p.X, p.Y
+
+			shapes = append(shapes, Shape{
+				Kind:   "circle",
+				Points: []Point{{x, y}},
+				Size:   radius,
+				R:      colorR,
+				G:      colorG,
+				B:      colorB,
+				Fill:   fillMode,
+				Style:  strokeStyle,
+				Clip:   currentClip,
+				ID:     id,
+			})
+			animShape, animLine = len(shapes)-1, -1
+			if verbose {
+				fmt.Fprintf(logOut, "Added circle at (%d,%d) radius %d color rgb(%d,%d,%d) fillMode %v\n",
+					   x, y, radius, colorR, colorG, colorB, fillMode)
+			}
+			continue
+		}
+
+		if isV2 && strings.HasPrefix(line, "LRSQUARE") {
+			// Format: LRSQUARE x,y,size..r,g,b [#id]
+			id, line := cutID(line)
+			parts := strings.SplitN(line, " ", 2)
+			if len(parts) < 2 {
+				warn("Skipping malformed LRSQUARE line")
+				continue
+			}
+			params := parts[1]
+			colorR, colorG, colorB := 0, 0, 0
+			if strings.Contains(params, "..") {
+				subparts := strings.Split(params, "..")
+				params = subparts[0]
+				rgbParts := strings.Split(subparts[1], ",")
+				if len(rgbParts) == 3 {
+					colorR, _ = strconv.Atoi(rgbParts[0])
+					colorG, _ = strconv.Atoi(rgbParts[1])
+					colorB, _ = strconv.Atoi(rgbParts[2])
+				}
+			}
+			vals := strings.Split(params, ",")
+			if len(vals) != 3 {
+				warn("Skipping malformed LRSQUARE parameters")
+				continue
+			}
+			x, _ := strconv.Atoi(vals[0])
+			y, _ := strconv.Atoi(vals[1])
+			size, _ := strconv.Atoi(vals[2])
+			p := orig.corner(x, y, size, box())
+			x, y = p.X, p.Y
+
+			shapes = append(shapes, Shape{
+				Kind:   "square",
+				Points: []Point{{x, y}},
+				Size:   size,
+				R:      colorR,
+				G:      colorG,
+				B:      colorB,
+				Fill:   fillMode,
+				Style:  strokeStyle,
+				Clip:   currentClip,
+				ID:     id,
+			})
+			animShape, animLine = len(shapes)-1, -1
+			if verbose {
+				fmt.Fprintf(logOut, "Added square at (%d,%d) size %d color rgb(%d,%d,%d) fillMode %v\n",
+					   x, y, size, colorR, colorG, colorB, fillMode)
+			}
+			continue
+		}
+
+		// The rest is line parsing like before:
+
+		// Optional marker spec after the color, e.g. "x1,y1,x2,y2..r,g,b <>",
+		// and ID, e.g. "x1,y1,x2,y2..r,g,b <> #arrow"
+		id, line := cutID(line)
+		var markers LineMarkers
+		if fields := strings.Fields(line); len(fields) == 2 {
+			if m, ok := parseMarkers(fields[1]); ok {
+				markers = m
+				line = fields[0]
+			}
+		}
+
+		colorR, colorG, colorB := 0, 0, 0
+		if strings.Contains(line, "..") {
+			parts := strings.Split(line, "..")
+			line = parts[0]
+			rgbParts := strings.Split(parts[1], ",")
+			if len(rgbParts) == 3 {
+				colorR, _ = strconv.Atoi(rgbParts[0])
+				colorG, _ = strconv.Atoi(rgbParts[1])
+				colorB, _ = strconv.Atoi(rgbParts[2])
+			}
+		}
+
+		parts := strings.Split(line, ",")
+		if len(parts) != 4 {
+			warn("Skipping malformed line: %s", line)
+			continue
+		}
+
+		x1, _ := strconv.Atoi(parts[0])
+		y1, _ := strconv.Atoi(parts[1])
+		x2, _ := strconv.Atoi(parts[2])
+		y2, _ := strconv.Atoi(parts[3])
+
+		coloredLines = append(coloredLines, ColoredLine{
+			Start:   orig.point(x1, y1, box()),
+			End:     orig.point(x2, y2, box()),
+			R:       colorR,
+			G:       colorG,
+			B:       colorB,
+			Style:   strokeStyle,
+			Markers: markers,
+			Clip:    currentClip,
+			ID:      id,
+		})
+		animShape, animLine = -1, len(coloredLines)-1
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading file: %v", err)
+	}
+
+	finishPage()
+	return pages, nil
+}
+
+// cutID splits the optional "#name" ID off the end of a primitive, as in
+// "LRCIRCLE 100,100,30..255,0,0 #sun". tween can match shapes by it.
+func cutID(line string) (id, rest string) {
+	fields := strings.Fields(line)
+	if n := len(fields); n > 1 && len(fields[n-1]) > 1 && fields[n-1][0] == '#' {
+		return fields[n-1][1:], strings.TrimSpace(strings.TrimSuffix(line, fields[n-1]))
+	}
+	return "", line
+}
+
+// parseKeyframe reads the LRANIMATE values for a shape of the given kind,
+// written like the shape itself and converted from the same origin. The
+// color is optional and stays r, g, b when left out.
+func parseKeyframe(spec, kind string, orig origin, box viewBox, r, g, b int) (Keyframe, bool) {
+	ints := func(s string) []int {
+		var vals []int
+		for _, v := range strings.Split(s, ",") {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil
+			}
+			vals = append(vals, n)
+		}
+		return vals
+	}
+
+	key := Keyframe{R: r, G: g, B: b}
+	if i := strings.Index(spec, ".."); i >= 0 {
+		rgb := ints(spec[i+2:])
+		if len(rgb) != 3 {
+			return key, false
+		}
+		key.R, key.G, key.B = rgb[0], rgb[1], rgb[2]
+		spec = spec[:i]
+	}
+	vals := ints(spec)
+	switch {
+	case kind == "line" && len(vals) == 4:
+		key.Points = []Point{orig.point(vals[0], vals[1], box), orig.point(vals[2], vals[3], box)}
+	case kind == "circle" && len(vals) == 3:
+		key.Points = []Point{orig.point(vals[0], vals[1], box)}
+		key.Size = vals[2]
+	case kind == "square" && len(vals) == 3:
+		key.Points = []Point{orig.corner(vals[0], vals[1], vals[2], box)}
+		key.Size = vals[2]
+	default:
+		return key, false
+	}
+	return key, true
+}
+
+// groupLines turns parsed lines into scene shapes. Four same-colored lines
+// that chain into a closed loop become a polygon when fill is on (always in
+// V1); all other lines are drawn as curves.
+func groupLines(coloredLines []ColoredLine, isV2, fillMode bool) []Shape {
+	var shapes []Shape
+
+	// Group and process lines. Lines with markers or keyframes are always
+	// drawn as strokes so they never take part in polygon detection.
+	// Groups are processed in order of first appearance so the output is
+	// stable.
+	groups := make(map[string][]ColoredLine)
+	var groupOrder []string
+	for _, line := range coloredLines {
+		if line.Markers != (LineMarkers{}) || len(line.Keyframes) > 0 {
+			shapes = append(shapes, line.shape())
+			continue
+		}
+		// Lines in different clip blocks never form a polygon together
+		key := fmt.Sprintf("%d,%d,%d|%d", line.R, line.G, line.B, line.Clip)
+		if _, ok := groups[key]; !ok {
+			groupOrder = append(groupOrder, key)
+		}
+		groups[key] = append(groups[key], line)
+	}
+
+	for _, key := range groupOrder {
+		lines := groups[key]
+		if len(lines) < 4 {
+			for _, l := range lines {
+				shapes = append(shapes, l.shape())
+			}
+			continue
+		}
+
+		used := make([]bool, len(lines))
+		var chain []Point
+		current := lines[0].Start
+		chain = append(chain, current)
+		used[0] = true
+		found := 1
+
+		for found < 4 {
+			madeProgress := false
+			for i, l := range lines {
+				if used[i] {
+					continue
+				}
+				if l.Start == current {
+					chain = append(chain, l.End)
+					current = l.End
+					used[i] = true
+					found++
+					madeProgress = true
+					break
+				} else if l.End == current {
+					chain = append(chain, l.Start)
+					current = l.Start
+					used[i] = true
+					found++
+					madeProgress = true
+					break
+				}
+			}
+			if !madeProgress {
+				break
+			}
+		}
+
+		// Close loop and check
+		chain = append(chain, chain[0])
+		if len(chain) == 5 && chain[0] == chain[4] {
+			polygon := Shape{
+				Kind:   "polygon",
+				Points: chain[:4],
+				R:      lines[0].R,
+				G:      lines[0].G,
+				B:      lines[0].B,
+				Fill:   true,
+				Style:  lines[0].Style,
+				Clip:   lines[0].Clip,
+			}
+			// The polygon goes by the first ID among its lines.
+			for i, l := range lines {
+				if used[i] && l.ID != "" {
+					polygon.ID = l.ID
+					break
+				}
+			}
+			if isV2 {
+				if fillMode {
+					shapes = append(shapes, polygon)
+				} else {
+					// Just stroke lines
+					for _, l := range lines {
+						shapes = append(shapes, l.shape())
+					}
+				}
+			} else {
+				// V1 always fill
+				shapes = append(shapes, polygon)
+			}
+		} else {
+			for _, l := range lines {
+				shapes = append(shapes, l.shape())
+			}
+		}
+	}
+
+	return shapes
+}
+
+// shape converts a parsed line into a scene line.
+func (l ColoredLine) shape() Shape {
+	return Shape{
+		Kind:      "line",
+		Points:    []Point{l.Start, l.End},
+		R:         l.R,
+		G:         l.G,
+		B:         l.B,
+		Style:     l.Style,
+		Markers:   l.Markers,
+		Clip:      l.Clip,
+		ID:        l.ID,
+		Keyframes: l.Keyframes,
+	}
+}
+
+// writeSVG writes the scene as an SVG document.
+func writeSVG(output io.Writer, scene *Scene) {
+	width, height := scene.Width, scene.Height
+	marginTop, marginBottom := scene.MarginTop, scene.MarginBottom
+	fontSize := scene.FontSize
+
+	markerDefs := make(map[string]string)
+	for _, shape := range scene.Shapes {
+		shape.Markers.addDefs(markerDefs, shape.R, shape.G, shape.B)
+	}
+
+	// Scaled and responsive output keep drawing in scene units through
+	// the viewBox.
+	switch scale := scene.pixelScale(); {
+	case scene.Responsive:
+		fmt.Fprintf(output, `<svg xmlns="http://www.w3.org/2000/svg" width="100%%" height="100%%" viewBox="0 0 %d %d">`+"\n", width, height)
+	case scale != 1:
+		fmt.Fprintf(output, `<svg xmlns="http://www.w3.org/2000/svg" width="%s" height="%s" viewBox="0 0 %d %d">`+"\n",
+			pdfNum(float64(width)*scale), pdfNum(float64(height)*scale), width, height)
+	default:
+		fmt.Fprintf(output, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d">`+"\n", width, height)
+	}
+	if !scene.Transparent {
+		bg := "white"
+		if scene.BgR != 255 || scene.BgG != 255 || scene.BgB != 255 {
+			bg = fmt.Sprintf("rgb(%d,%d,%d)", scene.BgR, scene.BgG, scene.BgB)
+		}
+		fmt.Fprintf(output, `<rect width="%d" height="%d" fill="%s"/>`+"\n", width, height, bg)
+	}
+
+	if len(markerDefs) > 0 || len(scene.Clips) > 0 {
+		ids := make([]string, 0, len(markerDefs))
+		for id := range markerDefs {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		fmt.Fprintln(output, "<defs>")
+		for _, id := range ids {
+			fmt.Fprintln(output, markerDefs[id])
+		}
+		for i, region := range scene.Clips {
+			fmt.Fprintln(output, clipPathDef(i+1, region, width, height, marginTop, marginBottom))
+		}
+		fmt.Fprintln(output, "</defs>")
+	}
+
+	if scene.TopText != "" {
+		y := marginTop + fontSize
+		if scene.TopLine {
+			fmt.Fprintf(output, `<line x1="0" y1="%d" x2="%d" y2="%d" stroke="black" stroke-width="1"/>`+"\n", y+4, width, y+4)
+		}
+		fmt.Fprintf(output, `<text x="10" y="%d" font-size="%d" fill="black">%s</text>`+"\n", y, fontSize, scene.TopText)
+	}
+
+	if scene.BottomText != "" {
+		y := height - marginBottom
+		if scene.BottomLine {
+			fmt.Fprintf(output, `<line x1="0" y1="%d" x2="%d" y2="%d" stroke="black" stroke-width="1"/>`+"\n", y-fontSize-4, width, y-fontSize-4)
+		}
+		fmt.Fprintf(output, `<text x="10" y="%d" font-size="%d" fill="black">%s</text>`+"\n", y, fontSize, scene.BottomText)
+	}
+
+	dur := sceneDuration(scene)
+	for _, shape := range scene.Shapes {
+		el := svgShape(shape, scene.CurveStrength)
+		if len(shape.Keyframes) > 0 {
+			el = svgAnimate(el, shape, scene, dur)
+		}
+		fmt.Fprintln(output, el)
+	}
+
+	fmt.Fprintln(output, `</svg>`)
+}
+
+func extractText(line string) string {
+	start := strings.Index(line, "'")
+	end := strings.LastIndex(line, "'")
+	if start == -1 || end == -1 || start == end {
+		return ""
+	}
+	return line[start+1 : end]
+}
+
+// svgShape returns the SVG element for a scene shape.
+func svgShape(s Shape, curveStrength int) string {
+	color := fmt.Sprintf("rgb(%d,%d,%d)", s.R, s.G, s.B)
+	fillAttr := "none"
+	if s.Fill {
+		fillAttr = color
+	}
+	extra := s.Style.svgAttrs() + clipAttr(s.Clip)
+
+	switch s.Kind {
+	case "circle":
+		return fmt.Sprintf(`<circle cx="%d" cy="%d" r="%d" fill="%s" stroke="%s" stroke-width="2"%s/>`,
+			s.Points[0].X, s.Points[0].Y, s.Size, fillAttr, color, extra)
+	case "square":
+		return fmt.Sprintf(`<rect x="%d" y="%d" width="%d" height="%d" fill="%s" stroke="%s" stroke-width="2"%s/>`,
+			s.Points[0].X, s.Points[0].Y, s.Size, s.Size, fillAttr, color, extra)
+	case "polygon":
+		points := make([]string, len(s.Points))
+		for i, p := range s.Points {
+			points[i] = fmt.Sprintf("%d,%d", p.X, p.Y)
+		}
+		return fmt.Sprintf(`<polygon points="%s" fill="%s" stroke="black" stroke-width="1"%s/>`,
+			strings.Join(points, " "), color, extra)
+	}
+	return curveLine(s, curveStrength)
+}
+
+func curveLine(l Shape, strength int) string {
+	start, end := l.Points[0], l.Points[1]
+	control := curveControl(start, end, strength)
+	color := fmt.Sprintf("rgb(%d,%d,%d)", l.R, l.G, l.B)
+	return fmt.Sprintf(`<path d="M %d %d Q %d %d %d %d" stroke="%s" fill="none" stroke-width="2"%s%s%s/>`,
+			   start.X, start.Y, control.X, control.Y, end.X, end.Y, color, l.Style.svgAttrs(),
+			   l.Markers.svgAttrs(l.R, l.G, l.B), clipAttr(l.Clip))
+}
+
+// sceneDuration returns the length of the scene's animation in seconds:
+// LRDURATION, or else the time of the last keyframe.
+func sceneDuration(scene *Scene) float64 {
+	if scene.Duration > 0 {
+		return scene.Duration
+	}
+	dur := 0.0
+	for _, sh := range scene.Shapes {
+		if n := len(sh.Keyframes); n > 0 {
+			dur = math.Max(dur, sh.Keyframes[n-1].Time)
+		}
+	}
+	return dur
+}
+
+// svgAnimate adds SMIL animation to el, the SVG element of s, that plays
+// its keyframes over dur seconds with the shape itself as frame 0. Keys
+// after dur are left out and the last value holds until the end. Moving
+// circles and squares use animateTransform; the transform would move
+// their clip path along, so the clip goes on a group around them.
+func svgAnimate(el string, s Shape, scene *Scene, dur float64) string {
+	keys := []Keyframe{{Points: s.Points, Size: s.Size, R: s.R, G: s.G, B: s.B}}
+	for _, k := range s.Keyframes {
+		if k.Time <= dur {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 1 {
+		return el
+	}
+	if last := keys[len(keys)-1]; last.Time < dur {
+		last.Time = dur
+		keys = append(keys, last)
+	}
+
+	times := make([]string, len(keys))
+	for i, k := range keys {
+		times[i] = pdfNum(k.Time / dur)
+	}
+	timing := fmt.Sprintf(` dur="%ss" keyTimes="%s"`, pdfNum(dur), strings.Join(times, ";"))
+	if scene.Repeat == 0 {
+		timing += ` repeatCount="indefinite"`
+	} else {
+		timing += fmt.Sprintf(` repeatCount="%d" fill="freeze"`, scene.Repeat)
+	}
+
+	var anims []string
+	// values returns the value of every key, or nil if they are all the
+	// same and there is nothing to animate.
+	values := func(value func(k Keyframe) string) []string {
+		vals := make([]string, len(keys))
+		changes := false
+		for i, k := range keys {
+			vals[i] = value(k)
+			changes = changes || vals[i] != vals[0]
+		}
+		if !changes {
+			return nil
+		}
+		return vals
+	}
+	animate := func(attr string, value func(k Keyframe) string) {
+		if vals := values(value); vals != nil {
+			anims = append(anims, fmt.Sprintf(`<animate attributeName="%s" values="%s"%s/>`, attr, strings.Join(vals, ";"), timing))
+		}
+	}
+	color := func(k Keyframe) string { return fmt.Sprintf("rgb(%d,%d,%d)", k.R, k.G, k.B) }
+	size := func(k Keyframe) string { return strconv.Itoa(k.Size) }
+
+	moved := false
+	switch s.Kind {
+	case "line":
+		animate("d", func(k Keyframe) string {
+			start, end := k.Points[0], k.Points[1]
+			control := curveControl(start, end, scene.CurveStrength)
+			return fmt.Sprintf("M %d %d Q %d %d %d %d", start.X, start.Y, control.X, control.Y, end.X, end.Y)
+		})
+	case "circle", "square":
+		offsets := values(func(k Keyframe) string {
+			return fmt.Sprintf("%d %d", k.Points[0].X-s.Points[0].X, k.Points[0].Y-s.Points[0].Y)
+		})
+		if offsets != nil {
+			anims = append(anims, fmt.Sprintf(`<animateTransform attributeName="transform" type="translate" values="%s"%s/>`,
+				strings.Join(offsets, ";"), timing))
+			moved = true
+		}
+		if s.Kind == "circle" {
+			animate("r", size)
+		} else {
+			animate("width", size)
+			animate("height", size)
+		}
+		if s.Fill {
+			animate("fill", color)
+		}
+	}
+	animate("stroke", color)
+	if len(anims) == 0 {
+		return el
+	}
+
+	tag := el[1:strings.Index(el, " ")]
+	el = strings.TrimSuffix(el, "/>") + ">\n" + strings.Join(anims, "\n") + "\n</" + tag + ">"
+	if moved && s.Clip != 0 {
+		el = fmt.Sprintf("<g%s>\n%s\n</g>", clipAttr(s.Clip), strings.Replace(el, clipAttr(s.Clip), "", 1))
+	}
+	return el
+}
+
+// curveControl returns the quadratic control point curveLine bends a line
+// through: the midpoint, raised by the curve strength.
+func curveControl(start, end Point, strength int) Point {
+	mx := (start.X + end.X) / 2
+	my := (start.Y + end.Y) / 2
+	return Point{mx, my - strength}
+}
+
+// clipAttr returns the clip-path attribute for clip id, with a leading
+// space, or an empty string outside any LRCLIP block.
+func clipAttr(id int) string {
+	if id == 0 {
+		return ""
+	}
+	return fmt.Sprintf(` clip-path="url(#lr-clip-%d)"`, id)
+}
+
+// clipPathDef returns the <clipPath> element for a clip region. A nested
+// region is clipped by its parent so the two intersect.
+func clipPathDef(id int, region ClipRegion, width, height, marginTop, marginBottom int) string {
+	var shape string
+	switch region.Kind {
+	case "rect":
+		shape = fmt.Sprintf(`<rect x="%d" y="%d" width="%d" height="%d"/>`, region.X, region.Y, region.W, region.H)
+	case "circle":
+		shape = fmt.Sprintf(`<circle cx="%d" cy="%d" r="%d"/>`, region.X, region.Y, region.R)
+	case "poly":
+		points := make([]string, len(region.Points))
+		for i, p := range region.Points {
+			points[i] = fmt.Sprintf("%d,%d", p.X, p.Y)
+		}
+		shape = fmt.Sprintf(`<polygon points="%s"/>`, strings.Join(points, " "))
+	case "margin":
+		shape = fmt.Sprintf(`<rect x="0" y="%d" width="%d" height="%d"/>`, marginTop, width, height-marginTop-marginBottom)
+	}
+	return fmt.Sprintf(`<clipPath id="lr-clip-%d"%s>%s</clipPath>`, id, clipAttr(region.Parent), shape)
+}
+
+// parseMarkers reads a line-end marker spec. ">" puts an arrow at the end,
+// "<" at the start and "<>" at both. A two character spec names the start
+// and end marker in order, using "<" or ">" for an arrow, "o" for a dot, "|"
+// for a bar and "-" for nothing. A single "o" or "|" marks the end.
+func parseMarkers(spec string) (LineMarkers, bool) {
+	kind := func(c byte) (string, bool) {
+		switch c {
+		case '<', '>':
+			return "arrow", true
+		case 'o':
+			return "dot", true
+		case '|':
+			return "bar", true
+		case '-':
+			return "", true
+		}
+		return "", false
+	}
+
+	switch len(spec) {
+	case 1:
+		if spec == "<" {
+			return LineMarkers{Start: "arrow"}, true
+		}
+		end, ok := kind(spec[0])
+		if !ok || end == "" {
+			return LineMarkers{}, false
+		}
+		return LineMarkers{End: end}, true
+	case 2:
+		start, ok1 := kind(spec[0])
+		end, ok2 := kind(spec[1])
+		if !ok1 || !ok2 {
+			return LineMarkers{}, false
+		}
+		return LineMarkers{Start: start, End: end}, true
+	}
+	return LineMarkers{}, false
+}
+
+// writeLRLogic writes pages as a canonical V2 .lrlogic file that parses
+// back into the same scenes. Settings are written at the top of every
+// page, stroke style, fill and background only when they change.
+func writeLRLogic(w io.Writer, pages []*Scene) error {
+	lw := &lrWriter{bgR: 255, bgG: 255, bgB: 255}
+	lw.printf("LRFILE VERSION 2")
+	for i, scene := range pages {
+		if i > 0 {
+			lw.printf("LRPAGE")
+		}
+		if err := lw.page(scene); err != nil {
+			return fmt.Errorf("page %d: %v", i+1, err)
+		}
+	}
+	lw.printf("LREXIT")
+	_, err := io.WriteString(w, lw.b.String())
+	return err
+}
+
+// lrWriter holds the parser state that writeLRLogic has produced so far.
+type lrWriter struct {
+	b             strings.Builder
+	height        int
+	fill          bool
+	style         StrokeStyle
+	bgR, bgG, bgB int
+	transparent   bool
+	clips         []ClipRegion
+	stack         []int // open clip blocks, innermost last
+	opened        int   // clip ids opened so far on this page
+	duration      float64
+	repeat        int
+	view          bool // LRVIEWBOX is on
+}
+
+func (lw *lrWriter) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&lw.b, format+"\n", args...)
+}
+
+func (lw *lrWriter) page(scene *Scene) error {
+	lw.height = scene.Height
+	lw.clips, lw.stack, lw.opened = scene.Clips, nil, 0
+
+	// A scaled scene is written as a view of its own size, since the
+	// coordinates already start at the view's corner.
+	if scene.OutputWidth > 0 || scene.OutputHeight > 0 {
+		lw.printf("LRRESDEFINEX %d", scene.OutputWidth)
+		lw.printf("LRRESDEFINEY %d", scene.OutputHeight)
+		lw.printf("LRVIEWBOX 0,0,%d,%d", scene.Width, scene.Height)
+		lw.view = true
+	} else {
+		if lw.view {
+			lw.printf("LRVIEWBOX OFF")
+			lw.view = false
+		}
+		lw.printf("LRRESDEFINEX %d", scene.Width)
+		lw.printf("LRRESDEFINEY %d", scene.Height)
+	}
+	lw.printf("LRMARGIN %d %d", scene.MarginTop, scene.MarginBottom)
+	lw.printf("LRFONTSIZE %d", scene.FontSize)
+	lw.printf("LRCURVE %d", scene.CurveStrength)
+	if scene.Duration != lw.duration {
+		lw.printf("LRDURATION %s", strconv.FormatFloat(scene.Duration, 'f', -1, 64))
+		lw.duration = scene.Duration
+	}
+	if scene.Repeat != lw.repeat {
+		switch scene.Repeat {
+		case 0:
+			lw.printf("LRLOOP ON")
+		case 1:
+			lw.printf("LRLOOP OFF")
+		default:
+			lw.printf("LRLOOP %d", scene.Repeat)
+		}
+		lw.repeat = scene.Repeat
+	}
+	if scene.BgR != lw.bgR || scene.BgG != lw.bgG || scene.BgB != lw.bgB || (lw.transparent && !scene.Transparent) {
+		lw.printf("LRBACKGROUND %d,%d,%d", scene.BgR, scene.BgG, scene.BgB)
+		lw.bgR, lw.bgG, lw.bgB, lw.transparent = scene.BgR, scene.BgG, scene.BgB, false
+	}
+	if scene.Transparent && !lw.transparent {
+		lw.printf("LRBACKGROUND NONE")
+		lw.transparent = true
+	}
+	if scene.TopLine {
+		lw.printf("LRTXT.Top '%s'", scene.TopText)
+	}
+	if scene.BottomLine {
+		lw.printf("LRTXT.Bottom '%s'", scene.BottomText)
+	}
+
+	// The parser reorders shapes: circles and squares come before all
+	// lines, then lines with markers or keyframes, then the other lines
+	// grouped by color and clip block in order of first appearance. So the
+	// shapes are split into queues whose order matters only within a queue,
+	// apart from groups having to start in order, and the next shape is
+	// taken from whichever queue fits the open clip blocks best, as clip
+	// blocks can't be reopened.
+	queues := [][]Shape{nil, nil} // circles and squares, marker lines, groups...
+	groups := make(map[string]int)
+	polygons := false
+	for _, sh := range scene.Shapes {
+		for _, k := range sh.Keyframes {
+			if sh.Kind == "polygon" {
+				return errors.New("polygons can't have keyframes")
+			}
+			if len(k.Points) != len(sh.Points) {
+				return fmt.Errorf("%s keyframe at %gs needs %d points, has %d", sh.Kind, k.Time, len(sh.Points), len(k.Points))
+			}
+		}
+		switch sh.Kind {
+		case "circle", "square":
+			if len(sh.Points) != 1 {
+				return fmt.Errorf("%s needs 1 point, has %d", sh.Kind, len(sh.Points))
+			}
+			queues[0] = append(queues[0], sh)
+		case "line", "polygon":
+			if sh.Kind == "line" && len(sh.Points) != 2 {
+				return fmt.Errorf("line needs 2 points, has %d", len(sh.Points))
+			}
+			if sh.Kind == "polygon" && len(sh.Points) < 3 {
+				return fmt.Errorf("polygon needs at least 3 points, has %d", len(sh.Points))
+			}
+			polygons = polygons || sh.Kind == "polygon"
+			if sh.Markers != (LineMarkers{}) || len(sh.Keyframes) > 0 {
+				queues[1] = append(queues[1], sh)
+				continue
+			}
+			key := fmt.Sprintf("%d,%d,%d|%d", sh.R, sh.G, sh.B, sh.Clip)
+			if _, ok := groups[key]; !ok {
+				groups[key] = len(queues)
+				queues = append(queues, nil)
+			}
+			queues[groups[key]] = append(queues[groups[key]], sh)
+		default:
+			return fmt.Errorf("unknown shape kind %q", sh.Kind)
+		}
+	}
+	started := 2 // the first group that has not been drawn from yet
+	for {
+		best, bestCost := -1, 0
+		for q := 0; q < len(queues) && q <= started; q++ {
+			if len(queues[q]) == 0 {
+				continue
+			}
+			if cost := lw.cost(queues[q][0]); best < 0 || cost < bestCost {
+				best, bestCost = q, cost
+			}
+		}
+		if best < 0 {
+			break
+		}
+		lw.shape(queues[best][0])
+		queues[best] = queues[best][1:]
+		if best == started {
+			started++
+		}
+	}
+
+	// Clip blocks nothing was drawn in still take up their ids.
+	lw.moveClip(len(lw.clips), true)
+	lw.moveClip(0, true)
+	// Polygons are only detected when fill is on at the end of the page.
+	if lw.fill != polygons {
+		lw.setFill(polygons)
+	}
+	return nil
+}
+
+// cost rates how well sh fits the current state: 0 when nothing has to
+// change, more for every clip block closed or opened and a lot when it
+// can't be drawn as it is.
+func (lw *lrWriter) cost(sh Shape) int {
+	cost := 0
+	pops, opens, ok := lw.moveClip(sh.Clip, false)
+	if !ok {
+		cost += 1000
+	}
+	return cost + 10*pops + opens
+}
+
+// moveClip closes and opens clip blocks until id is the innermost open one
+// (or none is open for id 0) and returns how many blocks that closes and
+// opens. ok is false if it can't be done, because id was already closed or
+// its parent is. The blocks are only written when emit is set.
+func (lw *lrWriter) moveClip(id int, emit bool) (pops, opens int, ok bool) {
+	stack := append([]int(nil), lw.stack...)
+	ok = true
+	popTo := func(parent int) bool {
+		n := 0
+		if parent != 0 {
+			n = -1
+			for i, open := range stack {
+				if open == parent {
+					n = i + 1
+				}
+			}
+			if n < 0 {
+				return false
+			}
+		}
+		for len(stack) > n {
+			stack = stack[:len(stack)-1]
+			pops++
+			if emit {
+				lw.printf("LRCLIP END")
+			}
+		}
+		return true
+	}
+
+	opened := lw.opened
+	if id <= opened {
+		ok = popTo(id)
+	} else {
+		for ; opened < id && opened < len(lw.clips); opened++ {
+			region := lw.clips[opened]
+			if !popTo(region.Parent) {
+				ok = false
+				popTo(0)
+			}
+			stack = append(stack, opened+1)
+			opens++
+			if emit {
+				lw.clipLine(region)
+			}
+		}
+	}
+	if emit {
+		lw.stack, lw.opened = stack, opened
+	}
+	return pops, opens, ok
+}
+
+func (lw *lrWriter) clipLine(r ClipRegion) {
+	switch r.Kind {
+	case "rect":
+		lw.printf("LRCLIP RECT %d,%d,%d,%d", r.X, lw.height-r.Y-r.H, r.W, r.H)
+	case "circle":
+		lw.printf("LRCLIP CIRCLE %d,%d,%d", r.X, lw.height-r.Y, r.R)
+	case "poly":
+		var vals []string
+		for _, p := range r.Points {
+			vals = append(vals, fmt.Sprintf("%d,%d", p.X, lw.height-p.Y))
+		}
+		lw.printf("LRCLIP POLY %s", strings.Join(vals, ","))
+	default:
+		lw.printf("LRCLIP MARGIN")
+	}
+}
+
+func (lw *lrWriter) setFill(on bool) {
+	if on {
+		lw.printf("LRFILL ON")
+	} else {
+		lw.printf("LRFILL OFF")
+	}
+	lw.fill = on
+}
+
+func (lw *lrWriter) setStyle(st StrokeStyle) {
+	var dash []string
+	for _, n := range st.Dash {
+		dash = append(dash, strconv.Itoa(n))
+	}
+	var current []string
+	for _, n := range lw.style.Dash {
+		current = append(current, strconv.Itoa(n))
+	}
+	if strings.Join(dash, ",") != strings.Join(current, ",") {
+		if len(dash) == 0 {
+			lw.printf("LRDASH OFF")
+		} else {
+			lw.printf("LRDASH %s", strings.Join(dash, ","))
+		}
+	}
+	// An empty cap or join is the default, which has to be set again
+	// explicitly after another one.
+	if st.Cap != lw.style.Cap {
+		val := st.Cap
+		if val == "" {
+			val = "default"
+		}
+		lw.printf("LRCAP %s", val)
+	}
+	if st.Join != lw.style.Join {
+		val := st.Join
+		if val == "" {
+			val = "default"
+		}
+		lw.printf("LRJOIN %s", val)
+	}
+	lw.style = st
+}
+
+func (lw *lrWriter) shape(sh Shape) {
+	lw.moveClip(sh.Clip, true)
+	lw.setStyle(sh.Style)
+	color := fmt.Sprintf("%d,%d,%d", sh.R, sh.G, sh.B)
+	p := sh.Points
+	switch sh.Kind {
+	case "circle":
+		if lw.fill != sh.Fill {
+			lw.setFill(sh.Fill)
+		}
+		lw.printf("LRCIRCLE %d,%d,%d..%s%s", p[0].X, lw.height-p[0].Y, sh.Size, color, idSuffix(sh.ID))
+	case "square":
+		if lw.fill != sh.Fill {
+			lw.setFill(sh.Fill)
+		}
+		lw.printf("LRSQUARE %d,%d,%d..%s%s", p[0].X, lw.height-p[0].Y-sh.Size, sh.Size, color, idSuffix(sh.ID))
+	case "line":
+		lw.lineTo(p[0], p[1], color, markerSpec(sh.Markers), sh.ID)
+	case "polygon":
+		// The first line starts at the first point but leads to the last
+		// one, so polygon detection walks the points in order.
+		lw.lineTo(p[0], p[len(p)-1], color, "", sh.ID)
+		for i := 0; i+1 < len(p); i++ {
+			lw.lineTo(p[i], p[i+1], color, "", "")
+		}
+	}
+	for _, k := range sh.Keyframes {
+		t := strconv.FormatFloat(k.Time, 'f', -1, 64)
+		color := fmt.Sprintf("%d,%d,%d", k.R, k.G, k.B)
+		kp := k.Points
+		switch sh.Kind {
+		case "line":
+			lw.printf("LRANIMATE %s %d,%d,%d,%d..%s", t, kp[0].X, lw.height-kp[0].Y, kp[1].X, lw.height-kp[1].Y, color)
+		case "circle":
+			lw.printf("LRANIMATE %s %d,%d,%d..%s", t, kp[0].X, lw.height-kp[0].Y, k.Size, color)
+		case "square":
+			lw.printf("LRANIMATE %s %d,%d,%d..%s", t, kp[0].X, lw.height-kp[0].Y-k.Size, k.Size, color)
+		}
+	}
+}
+
+func (lw *lrWriter) lineTo(a, b Point, color, markers, id string) {
+	line := fmt.Sprintf("%d,%d,%d,%d..%s", a.X, lw.height-a.Y, b.X, lw.height-b.Y, color)
+	if markers != "" {
+		line += " " + markers
+	}
+	lw.printf("%s%s", line, idSuffix(id))
+}
+
+// idSuffix returns the " #name" that cutID reads, or nothing without an
+// ID.
+func idSuffix(id string) string {
+	if id == "" {
+		return ""
+	}
+	return " #" + id
+}
+
+// markerSpec is the inverse of parseMarkers.
+func markerSpec(m LineMarkers) string {
+	if m == (LineMarkers{}) {
+		return ""
+	}
+	char := func(kind string, arrow byte) byte {
+		switch kind {
+		case "arrow":
+			return arrow
+		case "dot":
+			return 'o'
+		case "bar":
+			return '|'
+		}
+		return '-'
+	}
+	return string([]byte{char(m.Start, '<'), char(m.End, '>')})
+}
+
+func markerID(kind, side string, r, g, b int) string {
+	if kind == "arrow" {
+		return fmt.Sprintf("lr-arrow-%s-%d-%d-%d", side, r, g, b)
+	}
+	return fmt.Sprintf("lr-%s-%d-%d-%d", kind, r, g, b)
+}
+
+// markerDef returns the <marker> element for a marker kind in the given
+// color. Markers use orient="auto" so arrows follow the tangent of the curve
+// at the end they sit on.
+func markerDef(kind, side string, r, g, b int) string {
+	id := markerID(kind, side, r, g, b)
+	color := fmt.Sprintf("rgb(%d,%d,%d)", r, g, b)
+	switch kind {
+	case "arrow":
+		shape, refX := "M 0 0 L 10 5 L 0 10 z", 10
+		if side == "start" {
+			shape, refX = "M 10 0 L 0 5 L 10 10 z", 0
+		}
+		return fmt.Sprintf(`<marker id="%s" viewBox="0 0 10 10" refX="%d" refY="5" markerWidth="5" markerHeight="5" orient="auto"><path d="%s" fill="%s"/></marker>`,
+			id, refX, shape, color)
+	case "dot":
+		return fmt.Sprintf(`<marker id="%s" viewBox="0 0 10 10" refX="5" refY="5" markerWidth="3" markerHeight="3"><circle cx="5" cy="5" r="5" fill="%s"/></marker>`,
+			id, color)
+	case "bar":
+		return fmt.Sprintf(`<marker id="%s" viewBox="0 0 10 10" refX="5" refY="5" markerWidth="5" markerHeight="5" orient="auto"><rect x="4" y="0" width="2" height="10" fill="%s"/></marker>`,
+			id, color)
+	}
+	return ""
+}
+
+// addDefs records the marker definitions these markers need in defs.
+func (m LineMarkers) addDefs(defs map[string]string, r, g, b int) {
+	if m.Start != "" {
+		defs[markerID(m.Start, "start", r, g, b)] = markerDef(m.Start, "start", r, g, b)
+	}
+	if m.End != "" {
+		defs[markerID(m.End, "end", r, g, b)] = markerDef(m.End, "end", r, g, b)
+	}
+}
+
+// svgAttrs returns the marker-start/marker-end attributes, with a leading
+// space, or an empty string when the line has no markers.
+func (m LineMarkers) svgAttrs(r, g, b int) string {
+	attrs := ""
+	if m.Start != "" {
+		attrs += fmt.Sprintf(` marker-start="url(#%s)"`, markerID(m.Start, "start", r, g, b))
+	}
+	if m.End != "" {
+		attrs += fmt.Sprintf(` marker-end="url(#%s)"`, markerID(m.End, "end", r, g, b))
+	}
+	return attrs
+}
+
+// svgAttrs returns the extra stroke attributes for the style, with a leading
+// space, or an empty string for a plain solid stroke.
+func (s StrokeStyle) svgAttrs() string {
+	attrs := ""
+	if len(s.Dash) > 0 {
+		dash := make([]string, len(s.Dash))
+		for i, v := range s.Dash {
+			dash[i] = strconv.Itoa(v)
+		}
+		attrs += fmt.Sprintf(` stroke-dasharray="%s"`, strings.Join(dash, ","))
+	}
+	if s.Cap != "" {
+		attrs += fmt.Sprintf(` stroke-linecap="%s"`, s.Cap)
+	}
+	if s.Join != "" {
+		attrs += fmt.Sprintf(` stroke-linejoin="%s"`, s.Join)
+	}
+	return attrs
+}
+
+func checkCommand(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// The built-in renderer below draws a Scene straight into an image.RGBA so
+// raster output does not depend on rsvg-convert or ImageMagick. Shapes are
+// flattened to polygons in output pixels and filled with the nonzero rule
+// using rasterSubsamples sub-scanlines per pixel row and exact horizontal
+// coverage, which gives anti-aliased edges.
+
+const rasterSubsamples = 8
+
+// fpoint is a point in output pixels.
+type fpoint struct {
+	X, Y float64
+}
+
+type edge struct {
+	x0, y0, x1, y1 float64 // y0 < y1
+	dir            int
+}
+
+type crossing struct {
+	x   float64
+	dir int
+}
+
+// canvas is the state of one in-process render.
+type canvas struct {
+	scene *Scene
+	scale float64
+	img   *image.RGBA
+	w, h  int
+	cover []float32         // coverage of the shape being drawn
+	masks map[int][]float32 // coverage of each clip region, by clip id
+}
+
+// renderImage rasterizes the scene at the given scale (1 = canvas size,
+// pixelScale for the output size).
+func renderImage(scene *Scene, scale float64) *image.RGBA {
+	// The epsilon keeps fitted scales like 480/100 from adding a pixel.
+	w := int(math.Ceil(float64(scene.Width)*scale - 1e-9))
+	h := int(math.Ceil(float64(scene.Height)*scale - 1e-9))
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	c := &canvas{
+		scene: scene,
+		scale: scale,
+		img:   image.NewRGBA(image.Rect(0, 0, w, h)),
+		w:     w,
+		h:     h,
+		cover: make([]float32, w*h),
+		masks: make(map[int][]float32),
+	}
+
+	if !scene.Transparent {
+		bg := color.RGBA{uint8(scene.BgR), uint8(scene.BgG), uint8(scene.BgB), 255}
+		draw.Draw(c.img, c.img.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+	}
+
+	// Text and divider lines, placed exactly like writeSVG places them
+	width := float64(scene.Width)
+	if scene.TopText != "" {
+		y := float64(scene.MarginTop + scene.FontSize)
+		if scene.TopLine {
+			c.strokeLine(fpoint{0, y + 4}, fpoint{width, y + 4}, 1, 0, 0, 0)
+		}
+		c.drawText(scene.TopText, 10, y)
+	}
+	if scene.BottomText != "" {
+		y := float64(scene.Height - scene.MarginBottom)
+		if scene.BottomLine {
+			ly := y - float64(scene.FontSize) - 4
+			c.strokeLine(fpoint{0, ly}, fpoint{width, ly}, 1, 0, 0, 0)
+		}
+		c.drawText(scene.BottomText, 10, y)
+	}
+
+	for _, shape := range scene.Shapes {
+		c.drawShape(shape)
+	}
+	return c.img
+}
+
+// pt converts a scene point to output pixels.
+func (c *canvas) pt(p Point) fpoint {
+	return fpoint{float64(p.X) * c.scale, float64(p.Y) * c.scale}
+}
+
+func (c *canvas) drawShape(s Shape) {
+	mask := c.clipMask(s.Clip)
+	strokeWidth := 2 * c.scale
+
+	switch s.Kind {
+	case "line":
+		start, end := s.Points[0], s.Points[1]
+		control := curveControl(start, end, c.scene.CurveStrength)
+		p0, ctrl, p1 := c.pt(start), c.pt(control), c.pt(end)
+		pts := flattenQuad(p0, ctrl, p1)
+		c.paint(strokePolys(pts, false, strokeWidth, s.Style, c.scale), s.R, s.G, s.B, mask)
+		if markers := markerPolys(s.Markers, p0, ctrl, p1, strokeWidth); len(markers) > 0 {
+			c.paint(markers, s.R, s.G, s.B, mask)
+		}
+	case "circle":
+		pts := circlePoints(c.pt(s.Points[0]), float64(s.Size)*c.scale)
+		if s.Fill {
+			c.paint([][]fpoint{pts}, s.R, s.G, s.B, mask)
+		}
+		c.paint(strokePolys(pts, true, strokeWidth, s.Style, c.scale), s.R, s.G, s.B, mask)
+	case "square":
+		pts := rectPoints(c.pt(s.Points[0]), float64(s.Size)*c.scale, float64(s.Size)*c.scale)
+		if s.Fill {
+			c.paint([][]fpoint{pts}, s.R, s.G, s.B, mask)
+		}
+		c.paint(strokePolys(pts, true, strokeWidth, s.Style, c.scale), s.R, s.G, s.B, mask)
+	case "polygon":
+		pts := make([]fpoint, len(s.Points))
+		for i, p := range s.Points {
+			pts[i] = c.pt(p)
+		}
+		c.paint([][]fpoint{pts}, s.R, s.G, s.B, mask)
+		c.paint(strokePolys(pts, true, c.scale, s.Style, c.scale), 0, 0, 0, mask)
+	}
+}
+
+// strokeLine draws a plain solid line given in scene units.
+func (c *canvas) strokeLine(a, b fpoint, width float64, r, g, bl int) {
+	a = fpoint{a.X * c.scale, a.Y * c.scale}
+	b = fpoint{b.X * c.scale, b.Y * c.scale}
+	c.paint(strokePolys([]fpoint{a, b}, false, width*c.scale, StrokeStyle{}, c.scale), r, g, bl, nil)
+}
+
+// markerPolys returns a line's end markers as polygons, the way markerDef
+// defines them: arrows follow the curve's tangent at each end, dots and bars
+// sit centered on the end point. Marker sizes scale with the stroke width.
+func markerPolys(m LineMarkers, p0, ctrl, p1 fpoint, strokeWidth float64) [][]fpoint {
+	unit := strokeWidth / 2 // one marker viewBox unit
+	mark := func(kind string, tip, dir fpoint) []fpoint {
+		nrm := fpoint{-dir.Y, dir.X}
+		at := func(along, across float64) fpoint {
+			return fpoint{tip.X + dir.X*along + nrm.X*across, tip.Y + dir.Y*along + nrm.Y*across}
+		}
+		switch kind {
+		case "arrow":
+			return []fpoint{at(0, 0), at(-10*unit, 5*unit), at(-10*unit, -5*unit)}
+		case "dot":
+			return circlePoints(tip, 3*unit)
+		case "bar":
+			return []fpoint{at(-unit, -5*unit), at(unit, -5*unit), at(unit, 5*unit), at(-unit, 5*unit)}
+		}
+		return nil
+	}
+
+	var polys [][]fpoint
+	if poly := mark(m.Start, p0, tangent(ctrl, p0, p1)); poly != nil {
+		polys = append(polys, poly)
+	}
+	if poly := mark(m.End, p1, tangent(ctrl, p1, p0)); poly != nil {
+		polys = append(polys, poly)
+	}
+	return polys
+}
+
+// tangent returns the unit direction from ctrl towards end, falling back to
+// the chord from other when the control point sits on the end point.
+func tangent(ctrl, end, other fpoint) fpoint {
+	d := fpoint{end.X - ctrl.X, end.Y - ctrl.Y}
+	if math.Hypot(d.X, d.Y) < 1e-9 {
+		d = fpoint{end.X - other.X, end.Y - other.Y}
+	}
+	l := math.Hypot(d.X, d.Y)
+	if l < 1e-9 {
+		return fpoint{1, 0}
+	}
+	return fpoint{d.X / l, d.Y / l}
+}
+
+// drawText draws text with the built-in 5x7 font, baseline at (x, y) in
+// scene units, at roughly the size an SVG viewer uses for the font size.
+func (c *canvas) drawText(text string, x, y float64) {
+	px := float64(c.scene.FontSize) / 10 * c.scale
+	top := y*c.scale - 7*px
+	left := x * c.scale
+	var polys [][]fpoint
+	for _, ch := range text {
+		if ch < 32 || ch > 126 {
+			ch = '?'
+		}
+		glyph := font5x7[ch-32]
+		for col, bits := range glyph {
+			for row := 0; row < 7; row++ {
+				if bits&(1<<uint(row)) != 0 {
+					polys = append(polys, rectPoints(fpoint{left + float64(col)*px, top + float64(row)*px}, px, px))
+				}
+			}
+		}
+		left += 6 * px
+	}
+	c.paint(polys, 0, 0, 0, nil)
+}
+
+// paint fills polys in the given color, limited by an optional clip mask.
+func (c *canvas) paint(polys [][]fpoint, r, g, b int, mask []float32) {
+	bounds := c.fill(polys)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := y*c.w + x
+			a := c.cover[i]
+			c.cover[i] = 0
+			if a <= 0 {
+				continue
+			}
+			if a > 1 {
+				a = 1
+			}
+			if mask != nil {
+				a *= mask[i]
+			}
+			blend(c.img, x, y, r, g, b, a)
+		}
+	}
+}
+
+// blend composites an opaque color with coverage a over the pixel at x, y.
+func blend(img *image.RGBA, x, y, r, g, b int, a float32) {
+	off := img.PixOffset(x, y)
+	pix := img.Pix[off : off+4 : off+4]
+	inv := 1 - a
+	pix[0] = uint8(float32(r)*a + float32(pix[0])*inv + 0.5)
+	pix[1] = uint8(float32(g)*a + float32(pix[1])*inv + 0.5)
+	pix[2] = uint8(float32(b)*a + float32(pix[2])*inv + 0.5)
+	pix[3] = uint8(255*a + float32(pix[3])*inv + 0.5)
+}
+
+// clipMask returns the coverage of clip region id intersected with its
+// parents, or nil for id 0.
+func (c *canvas) clipMask(id int) []float32 {
+	if id == 0 || id > len(c.scene.Clips) {
+		return nil
+	}
+	if mask, ok := c.masks[id]; ok {
+		return mask
+	}
+	region := c.scene.Clips[id-1]
+	parent := c.clipMask(region.Parent)
+
+	var poly []fpoint
+	switch region.Kind {
+	case "rect":
+		poly = rectPoints(c.pt(Point{region.X, region.Y}), float64(region.W)*c.scale, float64(region.H)*c.scale)
+	case "circle":
+		poly = circlePoints(c.pt(Point{region.X, region.Y}), float64(region.R)*c.scale)
+	case "poly":
+		for _, p := range region.Points {
+			poly = append(poly, c.pt(p))
+		}
+	case "margin":
+		top := float64(c.scene.MarginTop) * c.scale
+		bottom := float64(c.scene.Height-c.scene.MarginBottom) * c.scale
+		poly = rectPoints(fpoint{0, top}, float64(c.w), bottom-top)
+	}
+
+	mask := make([]float32, c.w*c.h)
+	bounds := c.fill([][]fpoint{poly})
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := y*c.w + x
+			a := c.cover[i]
+			c.cover[i] = 0
+			if a > 1 {
+				a = 1
+			}
+			if parent != nil {
+				a *= parent[i]
+			}
+			mask[i] = a
+		}
+	}
+	c.masks[id] = mask
+	return mask
+}
+
+// fill accumulates the coverage of polys, filled with the nonzero rule, into
+// c.cover and returns the pixel bounds it touched. Each polygon is oriented
+// the same way first so overlapping pieces of a stroke add up to their union.
+func (c *canvas) fill(polys [][]fpoint) image.Rectangle {
+	var edges []edge
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, poly := range polys {
+		reverse := signedArea(poly) < 0
+		n := len(poly)
+		for i := 0; i < n; i++ {
+			a, b := poly[i], poly[(i+1)%n]
+			if reverse {
+				a, b = b, a
+			}
+			minX, maxX = math.Min(minX, a.X), math.Max(maxX, a.X)
+			minY, maxY = math.Min(minY, a.Y), math.Max(maxY, a.Y)
+			if a.Y == b.Y {
+				continue
+			}
+			dir := 1
+			if a.Y > b.Y {
+				a, b = b, a
+				dir = -1
+			}
+			edges = append(edges, edge{a.X, a.Y, b.X, b.Y, dir})
+		}
+	}
+	if len(edges) == 0 {
+		return image.Rectangle{}
+	}
+	bounds := image.Rect(int(math.Floor(minX)), int(math.Floor(minY)), int(math.Ceil(maxX))+1, int(math.Ceil(maxY))+1)
+	bounds = bounds.Intersect(image.Rect(0, 0, c.w, c.h))
+	if bounds.Empty() {
+		return bounds
+	}
+
+	sort.Slice(edges, func(i, j int) bool { return edges[i].y0 < edges[j].y0 })
+	var active []int
+	var xs []crossing
+	next := 0
+	step := 1.0 / rasterSubsamples
+	for py := bounds.Min.Y; py < bounds.Max.Y; py++ {
+		for sub := 0; sub < rasterSubsamples; sub++ {
+			sy := float64(py) + (float64(sub)+0.5)*step
+			for next < len(edges) && edges[next].y0 <= sy {
+				active = append(active, next)
+				next++
+			}
+			xs = xs[:0]
+			kept := active[:0]
+			for _, ei := range active {
+				e := edges[ei]
+				if e.y1 <= sy {
+					continue
+				}
+				kept = append(kept, ei)
+				t := (sy - e.y0) / (e.y1 - e.y0)
+				xs = append(xs, crossing{e.x0 + t*(e.x1-e.x0), e.dir})
+			}
+			active = kept
+			sort.Slice(xs, func(i, j int) bool { return xs[i].x < xs[j].x })
+
+			winding := 0
+			start := 0.0
+			for _, cr := range xs {
+				prev := winding
+				winding += cr.dir
+				if prev == 0 && winding != 0 {
+					start = cr.x
+				} else if prev != 0 && winding == 0 {
+					c.addSpan(py, start, cr.x, float32(step))
+				}
+			}
+		}
+	}
+	return bounds
+}
+
+// addSpan adds weight times the horizontal coverage of [x0, x1) to row y.
+func (c *canvas) addSpan(y int, x0, x1 float64, weight float32) {
+	x0 = math.Max(x0, 0)
+	x1 = math.Min(x1, float64(c.w))
+	if x1 <= x0 {
+		return
+	}
+	row := c.cover[y*c.w : (y+1)*c.w]
+	i0, i1 := int(x0), int(x1)
+	if i0 == i1 {
+		row[i0] += weight * float32(x1-x0)
+		return
+	}
+	row[i0] += weight * float32(float64(i0+1)-x0)
+	for i := i0 + 1; i < i1; i++ {
+		row[i] += weight
+	}
+	if i1 < c.w {
+		row[i1] += weight * float32(x1-float64(i1))
+	}
+}
+
+func signedArea(poly []fpoint) float64 {
+	area := 0.0
+	for i := range poly {
+		a, b := poly[i], poly[(i+1)%len(poly)]
+		area += a.X*b.Y - b.X*a.Y
+	}
+	return area / 2
+}
+
+// flattenQuad approximates a quadratic Bézier curve with a polyline.
+func flattenQuad(p0, ctrl, p1 fpoint) []fpoint {
+	length := math.Hypot(ctrl.X-p0.X, ctrl.Y-p0.Y) + math.Hypot(p1.X-ctrl.X, p1.Y-ctrl.Y)
+	n := int(math.Ceil(length / 4))
+	if n < 4 {
+		n = 4
+	}
+	if n > 256 {
+		n = 256
+	}
+	return quadPoints(p0, ctrl, p1, n)
+}
+
+// quadPoints samples a quadratic Bézier curve into n segments.
+func quadPoints(p0, ctrl, p1 fpoint, n int) []fpoint {
+	pts := make([]fpoint, n+1)
+	for i := 0; i <= n; i++ {
+		t := float64(i) / float64(n)
+		u := 1 - t
+		pts[i] = fpoint{
+			u*u*p0.X + 2*u*t*ctrl.X + t*t*p1.X,
+			u*u*p0.Y + 2*u*t*ctrl.Y + t*t*p1.Y,
+		}
+	}
+	return pts
+}
+
+// circlePoints approximates a circle with a polygon fine enough that the
+// error stays well under a pixel.
+func circlePoints(center fpoint, r float64) []fpoint {
+	n := int(math.Ceil(2 * math.Pi * r / 2))
+	if n < 16 {
+		n = 16
+	}
+	if n > 720 {
+		n = 720
+	}
+	return circleSegments(center, r, n)
+}
+
+// circleSegments returns a regular n-gon inscribed in the circle.
+func circleSegments(center fpoint, r float64, n int) []fpoint {
+	pts := make([]fpoint, n)
+	for i := range pts {
+		a := 2 * math.Pi * float64(i) / float64(n)
+		pts[i] = fpoint{center.X + r*math.Cos(a), center.Y + r*math.Sin(a)}
+	}
+	return pts
+}
+
+func rectPoints(topLeft fpoint, w, h float64) []fpoint {
+	return []fpoint{
+		topLeft,
+		{topLeft.X + w, topLeft.Y},
+		{topLeft.X + w, topLeft.Y + h},
+		{topLeft.X, topLeft.Y + h},
+	}
+}
+
+// strokePolys returns polygons whose union is the stroke of the polyline,
+// following SVG's dash, cap and join rules. Dash lengths are scaled with the
+// output.
+func strokePolys(pts []fpoint, closed bool, width float64, style StrokeStyle, scale float64) [][]fpoint {
+	dashTotal := 0
+	for _, d := range style.Dash {
+		dashTotal += d
+	}
+	if dashTotal == 0 {
+		return strokePiece(pts, closed, width, style)
+	}
+
+	dash := make([]float64, len(style.Dash))
+	for i, d := range style.Dash {
+		dash[i] = float64(d) * scale
+	}
+	var polys [][]fpoint
+	for _, piece := range dashPolyline(pts, closed, dash) {
+		polys = append(polys, strokePiece(piece, false, width, style)...)
+	}
+	return polys
+}
+
+// dashPolyline splits a polyline into the "on" pieces of a dash pattern. An
+// odd-length pattern is repeated once, as in SVG.
+func dashPolyline(pts []fpoint, closed bool, dash []float64) [][]fpoint {
+	if closed && len(pts) > 0 {
+		pts = append(append([]fpoint{}, pts...), pts[0])
+	}
+	if len(dash)%2 == 1 {
+		dash = append(dash, dash...)
+	}
+	if len(pts) == 0 {
+		return nil
+	}
+
+	var out [][]fpoint
+	di := 0
+	remain := dash[0]
+	on := true
+	cur := []fpoint{pts[0]}
+	for i := 0; i+1 < len(pts); i++ {
+		a, b := pts[i], pts[i+1]
+		segLen := math.Hypot(b.X-a.X, b.Y-a.Y)
+		pos := 0.0
+		for segLen-pos > remain {
+			pos += remain
+			t := pos / segLen
+			p := fpoint{a.X + (b.X-a.X)*t, a.Y + (b.Y-a.Y)*t}
+			if on {
+				out = append(out, append(cur, p))
+				cur = nil
+			} else {
+				cur = []fpoint{p}
+			}
+			on = !on
+			di = (di + 1) % len(dash)
+			remain = dash[di]
+		}
+		remain -= segLen - pos
+		if on {
+			cur = append(cur, b)
+		}
+	}
+	if on && len(cur) > 0 {
+		out = append(out, cur)
+	}
+	return out
+}
+
+// strokePiece strokes one solid polyline: a quad per segment, a join at each
+// inner vertex and, for open polylines, a cap at each end.
+func strokePiece(pts []fpoint, closed bool, width float64, style StrokeStyle) [][]fpoint {
+	hw := width / 2
+	var clean []fpoint
+	for _, p := range pts {
+		if len(clean) == 0 || math.Hypot(p.X-clean[len(clean)-1].X, p.Y-clean[len(clean)-1].Y) > 1e-9 {
+			clean = append(clean, p)
+		}
+	}
+	if closed && len(clean) > 1 && clean[0] == clean[len(clean)-1] {
+		clean = clean[:len(clean)-1]
+	}
+
+	var polys [][]fpoint
+	if len(clean) < 2 {
+		// A zero-length dash still gets its caps, which is how dotted
+		// lines are drawn.
+		if len(clean) == 1 && !closed {
+			switch style.Cap {
+			case "round":
+				polys = append(polys, circlePoints(clean[0], hw))
+			case "square":
+				polys = append(polys, rectPoints(fpoint{clean[0].X - hw, clean[0].Y - hw}, width, width))
+			}
+		}
+		return polys
+	}
+
+	n := len(clean)
+	segments := n - 1
+	if closed {
+		segments = n
+	}
+	dirs := make([]fpoint, segments)
+	for i := 0; i < segments; i++ {
+		a, b := clean[i], clean[(i+1)%n]
+		l := math.Hypot(b.X-a.X, b.Y-a.Y)
+		dirs[i] = fpoint{(b.X - a.X) / l, (b.Y - a.Y) / l}
+	}
+
+	for i := 0; i < segments; i++ {
+		a, b := clean[i], clean[(i+1)%n]
+		d := dirs[i]
+		if !closed && style.Cap == "square" {
+			if i == 0 {
+				a = fpoint{a.X - d.X*hw, a.Y - d.Y*hw}
+			}
+			if i == segments-1 {
+				b = fpoint{b.X + d.X*hw, b.Y + d.Y*hw}
+			}
+		}
+		nx, ny := -d.Y*hw, d.X*hw
+		polys = append(polys, []fpoint{
+			{a.X + nx, a.Y + ny},
+			{b.X + nx, b.Y + ny},
+			{b.X - nx, b.Y - ny},
+			{a.X - nx, a.Y - ny},
+		})
+	}
+
+	for i := 0; i < n; i++ {
+		var d1, d2 fpoint
+		if closed {
+			d1, d2 = dirs[(i+segments-1)%segments], dirs[i%segments]
+		} else {
+			if i == 0 || i == n-1 {
+				continue
+			}
+			d1, d2 = dirs[i-1], dirs[i]
+		}
+		if join := joinPoly(clean[i], d1, d2, hw, style.Join); join != nil {
+			polys = append(polys, join)
+		}
+	}
+
+	if !closed && style.Cap == "round" {
+		polys = append(polys, circlePoints(clean[0], hw), circlePoints(clean[n-1], hw))
+	}
+	return polys
+}
+
+// joinPoly returns the polygon that fills the outer corner where a stroke
+// turns from direction d1 to d2 at v, or nil when no fill is needed.
+func joinPoly(v, d1, d2 fpoint, hw float64, join string) []fpoint {
+	cross := d1.X*d2.Y - d1.Y*d2.X
+	dot := d1.X*d2.X + d1.Y*d2.Y
+	if math.Abs(cross) < 1e-9 && dot > 0 {
+		return nil
+	}
+	if join == "round" {
+		return circlePoints(v, hw)
+	}
+
+	// Outer side of the turn
+	side := 1.0
+	if cross > 0 {
+		side = -1
+	}
+	o1 := fpoint{-d1.Y * hw * side, d1.X * hw * side}
+	o2 := fpoint{-d2.Y * hw * side, d2.X * hw * side}
+	bevel := []fpoint{v, {v.X + o1.X, v.Y + o1.Y}, {v.X + o2.X, v.Y + o2.Y}}
+	if join == "bevel" {
+		return bevel
+	}
+
+	// Miter, falling back to bevel past SVG's default miter limit of 4
+	mx, my := o1.X+o2.X, o1.Y+o2.Y
+	ml := math.Hypot(mx, my)
+	if ml < 1e-9 {
+		return bevel
+	}
+	mx, my = mx/ml, my/ml
+	cosHalf := (o1.X*mx + o1.Y*my) / hw
+	if cosHalf < 0.25 {
+		return bevel
+	}
+	miter := fpoint{v.X + mx*hw/cosHalf, v.Y + my*hw/cosHalf}
+	return []fpoint{v, {v.X + o1.X, v.Y + o1.Y}, miter, {v.X + o2.X, v.Y + o2.Y}}
+}
+
+// writeJPG encodes img as a JPG, flattening any transparency onto white
+// since JPG has no alpha channel.
+func writeJPG(w io.Writer, img image.Image, quality int) error {
+	return jpeg.Encode(w, flatten(img, img.Bounds().Dx(), img.Bounds().Dy()), &jpeg.Options{Quality: quality})
+}
+
+// flatten draws img over a white w by h canvas.
+func flatten(img image.Image, w, h int) *image.RGBA {
+	flat := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+	return flat
+}
+
+// gifOptions are the settings for animated GIF output.
+type gifOptions struct {
+	Delay  int  // milliseconds per frame
+	Loop   int  // times to play, 0 forever, -1 to follow LRLOOP
+	Colors int  // palette size
+	Dither bool // Floyd-Steinberg dithering
+}
+
+// writeGIF writes the pages as an animated GIF with the built-in
+// renderer. Every page is a frame, and pages with LRANIMATE keyframes are
+// played through at one frame per delay. All frames share one palette so
+// colors don't flicker between them. GIF has no partial transparency, so
+// transparent backgrounds are flattened onto white.
+func writeGIF(w io.Writer, pages []*Scene, scale float64, opts gifOptions) error {
+	var frames []*image.RGBA
+	width, height := 0, 0
+	for _, scene := range pages {
+		for _, t := range frameTimes(scene, float64(opts.Delay)/1000) {
+			img := renderImage(sceneAt(scene, t), scale*scene.pixelScale())
+			b := img.Bounds()
+			frames = append(frames, flatten(img, b.Dx(), b.Dy()))
+			width, height = max(width, b.Dx()), max(height, b.Dy())
+		}
+	}
+
+	pal := medianCut(frames, opts.Colors)
+	anim := &gif.GIF{Config: image.Config{ColorModel: pal, Width: width, Height: height}}
+	for _, frame := range frames {
+		p := image.NewPaletted(frame.Bounds(), pal)
+		if opts.Dither {
+			draw.FloydSteinberg.Draw(p, p.Bounds(), frame, image.Point{})
+		} else {
+			mapToPalette(p, frame)
+		}
+		anim.Image = append(anim.Image, p)
+		anim.Delay = append(anim.Delay, (opts.Delay+5)/10)
+		anim.Disposal = append(anim.Disposal, gif.DisposalBackground)
+	}
+
+	// gif.GIF counts repeats after the first play, with 0 meaning forever
+	// and -1 none.
+	plays := opts.Loop
+	if plays < 0 {
+		plays = pages[0].Repeat
+	}
+	switch plays {
+	case 0:
+		anim.LoopCount = 0
+	case 1:
+		anim.LoopCount = -1
+	default:
+		anim.LoopCount = plays - 1
+	}
+	return gif.EncodeAll(w, anim)
+}
+
+// frameTimes returns the times to sample a page at, step seconds apart.
+// A page without animation is a single frame. A looping animation leaves
+// out its last moment since that is where it starts again, one that plays
+// a set number of times ends on it.
+func frameTimes(scene *Scene, step float64) []float64 {
+	dur := sceneDuration(scene)
+	if dur <= 0 {
+		return []float64{0}
+	}
+	var times []float64
+	for i := 0; float64(i)*step < dur-1e-9; i++ {
+		times = append(times, float64(i)*step)
+	}
+	if scene.Repeat != 0 {
+		times = append(times, dur)
+	}
+	return times
+}
+
+// sceneAt returns the scene as it is t seconds into its animation, every
+// shape with keyframes moved to its interpolated points, size and color
+// the way svgAnimate plays them.
+func sceneAt(scene *Scene, t float64) *Scene {
+	dur := sceneDuration(scene)
+	frame := *scene
+	frame.Shapes = make([]Shape, len(scene.Shapes))
+	for i, sh := range scene.Shapes {
+		frame.Shapes[i] = sh
+		prev := Keyframe{Points: sh.Points, Size: sh.Size, R: sh.R, G: sh.G, B: sh.B}
+		for _, k := range sh.Keyframes {
+			if k.Time > dur {
+				break
+			}
+			if k.Time <= t {
+				prev = k
+				continue
+			}
+			f := (t - prev.Time) / (k.Time - prev.Time)
+			lerp := func(a, b int) int { return int(math.Round(float64(a) + f*float64(b-a))) }
+			points := make([]Point, len(prev.Points))
+			for j := range points {
+				points[j] = Point{lerp(prev.Points[j].X, k.Points[j].X), lerp(prev.Points[j].Y, k.Points[j].Y)}
+			}
+			prev = Keyframe{Points: points, Size: lerp(prev.Size, k.Size), R: lerp(prev.R, k.R), G: lerp(prev.G, k.G), B: lerp(prev.B, k.B)}
+			break
+		}
+		frame.Shapes[i].Points, frame.Shapes[i].Size = prev.Points, prev.Size
+		frame.Shapes[i].R, frame.Shapes[i].G, frame.Shapes[i].B = prev.R, prev.G, prev.B
+	}
+	return &frame
+}
+
+// medianCut builds a palette of at most n colors for the frames. The
+// colors are put in one box that is split again and again at the median
+// of its widest channel, always splitting the box with the most pixels
+// that still has more than one color, and every box gives its average
+// color. Big frames are sampled rather than read pixel by pixel.
+func medianCut(frames []*image.RGBA, n int) color.Palette {
+	counts := make(map[[3]uint8]int)
+	total := 0
+	for _, f := range frames {
+		total += len(f.Pix) / 4
+	}
+	step := max(1, total/(1<<20))
+	for _, f := range frames {
+		for i := 0; i < len(f.Pix); i += 4 * step {
+			counts[[3]uint8{f.Pix[i], f.Pix[i+1], f.Pix[i+2]}]++
+		}
+	}
+
+	type entry struct {
+		c     [3]uint8
+		count int
+	}
+	type box struct {
+		entries []entry
+		pixels  int
+	}
+	all := box{}
+	for c, count := range counts {
+		all.entries = append(all.entries, entry{c, count})
+		all.pixels += count
+	}
+	// Map order is random; sorting keeps the palette the same every run.
+	sort.Slice(all.entries, func(i, j int) bool {
+		a, b := all.entries[i].c, all.entries[j].c
+		return a[0] < b[0] || a[0] == b[0] && (a[1] < b[1] || a[1] == b[1] && a[2] < b[2])
+	})
+
+	boxes := []box{all}
+	for len(boxes) < n {
+		best := -1
+		for i, b := range boxes {
+			if len(b.entries) > 1 && (best < 0 || b.pixels > boxes[best].pixels) {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+		b := boxes[best]
+		ch, widest := 0, -1
+		for c := 0; c < 3; c++ {
+			lo, hi := 255, 0
+			for _, e := range b.entries {
+				lo, hi = min(lo, int(e.c[c])), max(hi, int(e.c[c]))
+			}
+			if hi-lo > widest {
+				ch, widest = c, hi-lo
+			}
+		}
+		sort.SliceStable(b.entries, func(i, j int) bool { return b.entries[i].c[ch] < b.entries[j].c[ch] })
+		half, cut := 0, 1
+		for i, e := range b.entries[:len(b.entries)-1] {
+			half += e.count
+			cut = i + 1
+			if half*2 >= b.pixels {
+				break
+			}
+		}
+		lower, upper := box{entries: b.entries[:cut]}, box{entries: b.entries[cut:]}
+		for _, e := range lower.entries {
+			lower.pixels += e.count
+		}
+		upper.pixels = b.pixels - lower.pixels
+		boxes[best] = lower
+		boxes = append(boxes, upper)
+	}
+
+	pal := make(color.Palette, len(boxes))
+	for i, b := range boxes {
+		var r, g, bl int
+		for _, e := range b.entries {
+			r += int(e.c[0]) * e.count
+			g += int(e.c[1]) * e.count
+			bl += int(e.c[2]) * e.count
+		}
+		pal[i] = color.RGBA{uint8(r / b.pixels), uint8(g / b.pixels), uint8(bl / b.pixels), 255}
+	}
+	return pal
+}
+
+// mapToPalette sets every pixel of dst to the palette color nearest to the
+// one in src. Drawings have few distinct colors, so the lookups are cached.
+func mapToPalette(dst *image.Paletted, src *image.RGBA) {
+	cache := make(map[[3]uint8]uint8)
+	for y := 0; y < src.Bounds().Dy(); y++ {
+		for x := 0; x < src.Bounds().Dx(); x++ {
+			i := src.PixOffset(x, y)
+			c := [3]uint8{src.Pix[i], src.Pix[i+1], src.Pix[i+2]}
+			idx, ok := cache[c]
+			if !ok {
+				idx = uint8(dst.Palette.Index(color.RGBA{c[0], c[1], c[2], 255}))
+				cache[c] = idx
+			}
+			dst.Pix[dst.PixOffset(x, y)] = idx
+		}
+	}
+}
+
+// writeFile creates path and fills it with write.
+func writeFile(path string, write func(io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// pageSizes are the --page presets in PostScript points, portrait.
+var pageSizes = map[string][2]float64{
+	"a3":     {841.89, 1190.55},
+	"a4":     {595.28, 841.89},
+	"a5":     {419.53, 595.28},
+	"letter": {612, 792},
+	"legal":  {612, 1008},
+}
+
+// pageSize returns the portrait size of a --page preset. "fit" is valid and
+// returns zero sizes, meaning each page is sized to its canvas.
+func pageSize(name string) (w, h float64, ok bool) {
+	name = strings.ToLower(name)
+	if name == "fit" {
+		return 0, 0, true
+	}
+	size, ok := pageSizes[name]
+	return size[0], size[1], ok
+}
+
+// pdfMargin is the blank border, in points, kept around a canvas that is
+// fitted to a preset page size.
+const pdfMargin = 36
+
+// writePDF writes every page as a vector PDF page. With --page fit each page
+// is the canvas size at 96 DPI; with a preset the canvas is scaled to fit
+// inside the page margins, centered, and the page is turned to landscape
+// when the canvas is wider than it is tall.
+func writePDF(w io.Writer, pages []*Scene, page string) error {
+	var buf bytes.Buffer
+	var offsets []int
+	startObj := func() int {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n", len(offsets))
+		return len(offsets)
+	}
+
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	startObj()
+	buf.WriteString("<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+
+	startObj()
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+2*i)
+	}
+	fmt.Fprintf(&buf, "<< /Type /Pages /Kids [%s] /Count %d >>\nendobj\n", strings.Join(kids, " "), len(pages))
+
+	// Times matches the serif font SVG viewers use for the text
+	startObj()
+	buf.WriteString("<< /Type /Font /Subtype /Type1 /BaseFont /Times-Roman /Encoding /WinAnsiEncoding >>\nendobj\n")
+
+	presetW, presetH, _ := pageSize(page)
+	for _, scene := range pages {
+		w, h := float64(scene.Width), float64(scene.Height)
+		var pw, ph, s, tx, ty float64
+		if presetW == 0 {
+			s = 0.75 * scene.pixelScale() // CSS pixels to points
+			pw, ph = w*s, h*s
+			tx, ty = 0, ph
+		} else {
+			pw, ph = presetW, presetH
+			if w > h {
+				pw, ph = ph, pw
+			}
+			s = math.Min((pw-2*pdfMargin)/w, (ph-2*pdfMargin)/h)
+			tx = (pw - w*s) / 2
+			ty = ph - (ph-h*s)/2
+		}
+
+		var content bytes.Buffer
+		zw := zlib.NewWriter(&content)
+		// Flip to the scene's top-left origin so shapes can be written in
+		// scene coordinates.
+		fmt.Fprintf(zw, "q\n%s 0 0 %s %s %s cm\n", pdfNum(s), pdfNum(-s), pdfNum(tx), pdfNum(ty))
+		zw.Write([]byte(pdfScene(scene)))
+		zw.Write([]byte("Q\n"))
+		zw.Close()
+
+		pageObj := startObj()
+		fmt.Fprintf(&buf, "<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>\nendobj\n",
+			pdfNum(pw), pdfNum(ph), pageObj+1)
+
+		startObj()
+		fmt.Fprintf(&buf, "<< /Length %d /Filter /FlateDecode >>\nstream\n", content.Len())
+		buf.Write(content.Bytes())
+		buf.WriteString("\nendstream\nendobj\n")
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// pdfScene returns the content stream operators for a scene, in scene
+// coordinates with the y axis already flipped by the caller.
+func pdfScene(scene *Scene) string {
+	var b strings.Builder
+	w, h := scene.Width, scene.Height
+
+	// Clip to the canvas like an SVG viewport
+	fmt.Fprintf(&b, "0 0 %d %d re W n\n", w, h)
+	if !scene.Transparent {
+		fmt.Fprintf(&b, "%s rg 0 0 %d %d re f\n", pdfColor(scene.BgR, scene.BgG, scene.BgB), w, h)
+	}
+
+	text := func(s string, y int) {
+		fmt.Fprintf(&b, "0 g BT /F1 %d Tf 1 0 0 -1 10 %d Tm (%s) Tj ET\n", scene.FontSize, y, pdfString(s))
+	}
+	if scene.TopText != "" {
+		y := scene.MarginTop + scene.FontSize
+		if scene.TopLine {
+			fmt.Fprintf(&b, "0 G 1 w 0 %d m %d %d l S\n", y+4, w, y+4)
+		}
+		text(scene.TopText, y)
+	}
+	if scene.BottomText != "" {
+		y := h - scene.MarginBottom
+		if scene.BottomLine {
+			ly := y - scene.FontSize - 4
+			fmt.Fprintf(&b, "0 G 1 w 0 %d m %d %d l S\n", ly, w, ly)
+		}
+		text(scene.BottomText, y)
+	}
+
+	for _, shape := range scene.Shapes {
+		b.WriteString("q\n")
+		pdfClip(&b, scene, shape.Clip)
+		b.WriteString(pdfStrokeStyle(shape.Style))
+		color := pdfColor(shape.R, shape.G, shape.B)
+		paint := "S"
+		if shape.Fill {
+			paint = "B"
+		}
+
+		switch shape.Kind {
+		case "line":
+			start, end := shape.Points[0], shape.Points[1]
+			control := curveControl(start, end, scene.CurveStrength)
+			p0, ctrl, p1 := toFPoint(start), toFPoint(control), toFPoint(end)
+			c1, c2 := quadToCubic(p0, ctrl, p1)
+			fmt.Fprintf(&b, "%s RG 2 w %s %s m %s %s %s %s %s %s c S\n", color,
+				pdfNum(p0.X), pdfNum(p0.Y), pdfNum(c1.X), pdfNum(c1.Y), pdfNum(c2.X), pdfNum(c2.Y), pdfNum(p1.X), pdfNum(p1.Y))
+			polys := markerPolys(shape.Markers, p0, ctrl, p1, 2)
+			if len(polys) > 0 {
+				fmt.Fprintf(&b, "%s rg\n", color)
+				for _, poly := range polys {
+					b.WriteString(pdfPolygon(poly))
+				}
+				b.WriteString("f\n")
+			}
+		case "circle":
+			fmt.Fprintf(&b, "%s RG %s rg 2 w\n%s%s\n", color, color, pdfCircle(toFPoint(shape.Points[0]), float64(shape.Size)), paint)
+		case "square":
+			p := shape.Points[0]
+			fmt.Fprintf(&b, "%s RG %s rg 2 w %d %d %d %d re %s\n", color, color, p.X, p.Y, shape.Size, shape.Size, paint)
+		case "polygon":
+			pts := make([]fpoint, len(shape.Points))
+			for i, p := range shape.Points {
+				pts[i] = toFPoint(p)
+			}
+			fmt.Fprintf(&b, "0 G %s rg 1 w\n%sB\n", color, pdfPolygon(pts))
+		}
+		b.WriteString("Q\n")
+	}
+	return b.String()
+}
+
+// pdfClip intersects the clipping path with a clip region and its parents.
+func pdfClip(b *strings.Builder, scene *Scene, id int) {
+	if id == 0 || id > len(scene.Clips) {
+		return
+	}
+	region := scene.Clips[id-1]
+	pdfClip(b, scene, region.Parent)
+	switch region.Kind {
+	case "rect":
+		fmt.Fprintf(b, "%d %d %d %d re", region.X, region.Y, region.W, region.H)
+	case "circle":
+		b.WriteString(pdfCircle(fpoint{float64(region.X), float64(region.Y)}, float64(region.R)))
+	case "poly":
+		pts := make([]fpoint, len(region.Points))
+		for i, p := range region.Points {
+			pts[i] = toFPoint(p)
+		}
+		b.WriteString(pdfPolygon(pts))
+	case "margin":
+		fmt.Fprintf(b, "0 %d %d %d re", scene.MarginTop, scene.Width, scene.Height-scene.MarginTop-scene.MarginBottom)
+	}
+	b.WriteString(" W n\n")
+}
+
+// pdfStrokeStyle returns the dash, cap and join operators for a style. The
+// miter limit is set to SVG's default of 4.
+func pdfStrokeStyle(style StrokeStyle) string {
+	dash := make([]string, len(style.Dash))
+	for i, d := range style.Dash {
+		dash[i] = strconv.Itoa(d)
+	}
+	capStyle := map[string]int{"round": 1, "square": 2}[style.Cap]
+	joinStyle := map[string]int{"round": 1, "bevel": 2}[style.Join]
+	return fmt.Sprintf("[%s] 0 d %d J %d j 4 M\n", strings.Join(dash, " "), capStyle, joinStyle)
+}
+
+func pdfPolygon(pts []fpoint) string {
+	var b strings.Builder
+	for i, p := range pts {
+		op := "l"
+		if i == 0 {
+			op = "m"
+		}
+		fmt.Fprintf(&b, "%s %s %s ", pdfNum(p.X), pdfNum(p.Y), op)
+	}
+	b.WriteString("h\n")
+	return b.String()
+}
+
+// pdfCircle returns a closed circle path made of four cubic Bézier arcs.
+func pdfCircle(c fpoint, r float64) string {
+	k := 0.5522847498 * r
+	return fmt.Sprintf("%s %s m %s %s %s %s %s %s c %s %s %s %s %s %s c %s %s %s %s %s %s c %s %s %s %s %s %s c h ",
+		pdfNum(c.X+r), pdfNum(c.Y),
+		pdfNum(c.X+r), pdfNum(c.Y+k), pdfNum(c.X+k), pdfNum(c.Y+r), pdfNum(c.X), pdfNum(c.Y+r),
+		pdfNum(c.X-k), pdfNum(c.Y+r), pdfNum(c.X-r), pdfNum(c.Y+k), pdfNum(c.X-r), pdfNum(c.Y),
+		pdfNum(c.X-r), pdfNum(c.Y-k), pdfNum(c.X-k), pdfNum(c.Y-r), pdfNum(c.X), pdfNum(c.Y-r),
+		pdfNum(c.X+k), pdfNum(c.Y-r), pdfNum(c.X+r), pdfNum(c.Y-k), pdfNum(c.X+r), pdfNum(c.Y))
+}
+
+func pdfColor(r, g, b int) string {
+	return fmt.Sprintf("%s %s %s", pdfNum(float64(r)/255), pdfNum(float64(g)/255), pdfNum(float64(b)/255))
+}
+
+// pdfNum formats a number with at most three decimals and no trailing zeros.
+func pdfNum(f float64) string {
+	s := strconv.FormatFloat(f, 'f', 3, 64)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	if s == "-0" || s == "" {
+		return "0"
+	}
+	return s
+}
+
+// pdfString escapes text for a PDF literal string. Characters outside
+// printable ASCII are replaced with '?'.
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func toFPoint(p Point) fpoint {
+	return fpoint{float64(p.X), float64(p.Y)}
+}
+
+// quadToCubic returns the two control points of the cubic Bézier curve that
+// traces the same path as the quadratic curve p0, ctrl, p1.
+func quadToCubic(p0, ctrl, p1 fpoint) (fpoint, fpoint) {
+	c1 := fpoint{p0.X + 2.0/3*(ctrl.X-p0.X), p0.Y + 2.0/3*(ctrl.Y-p0.Y)}
+	c2 := fpoint{p1.X + 2.0/3*(ctrl.X-p1.X), p1.Y + 2.0/3*(ctrl.Y-p1.Y)}
+	return c1, c2
+}
+
+// writeEPS writes a scene as Encapsulated PostScript, sized like a PDF
+// page with --page fit: one canvas pixel is 0.75 points. Shapes are drawn
+// the way pdfScene draws them, with the curves as cubic curveto.
+func writeEPS(w io.Writer, scene *Scene) error {
+	var b strings.Builder
+	s := 0.75 * scene.pixelScale() // CSS pixels to points
+	pw, ph := float64(scene.Width)*s, float64(scene.Height)*s
+	b.WriteString("%!PS-Adobe-3.0 EPSF-3.0\n")
+	fmt.Fprintf(&b, "%%%%BoundingBox: 0 0 %d %d\n", int(math.Ceil(pw)), int(math.Ceil(ph)))
+	fmt.Fprintf(&b, "%%%%HiResBoundingBox: 0 0 %s %s\n", pdfNum(pw), pdfNum(ph))
+	b.WriteString("%%Creator: lrlogic\n%%LanguageLevel: 2\n%%Pages: 1\n")
+	if scene.TopText != "" || scene.BottomText != "" {
+		b.WriteString("%%DocumentNeededResources: font Times-Roman\n")
+	}
+	b.WriteString("%%EndComments\n%%Page: 1 1\n")
+	// Flip to the scene's top-left origin so shapes can be written in
+	// scene coordinates.
+	fmt.Fprintf(&b, "gsave\n0 %s translate %s %s scale\n", pdfNum(ph), pdfNum(s), pdfNum(-s))
+	b.WriteString(psScene(scene))
+	b.WriteString("grestore\nshowpage\n%%EOF\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// psScene returns the PostScript for a scene, in scene coordinates with
+// the y axis already flipped by the caller.
+func psScene(scene *Scene) string {
+	var b strings.Builder
+	w, h := scene.Width, scene.Height
+	rect := func(x, y, w, h int) string {
+		return fmt.Sprintf("%d %d moveto %d 0 rlineto 0 %d rlineto %d 0 rlineto closepath\n", x, y, w, h, -w)
+	}
+
+	// Clip to the canvas like an SVG viewport
+	b.WriteString(rect(0, 0, w, h) + "clip newpath\n")
+	if !scene.Transparent {
+		fmt.Fprintf(&b, "%s setrgbcolor\n%sfill\n", pdfColor(scene.BgR, scene.BgG, scene.BgB), rect(0, 0, w, h))
+	}
+
+	line := func(y int) {
+		fmt.Fprintf(&b, "0 setgray 1 setlinewidth 0 %d moveto %d %d lineto stroke\n", y, w, y)
+	}
+	// Text is drawn in a flipped frame so the glyphs are upright.
+	text := func(s string, y int) {
+		fmt.Fprintf(&b, "0 setgray /Times-Roman findfont %d scalefont setfont\ngsave 10 %d translate 1 -1 scale 0 0 moveto (%s) show grestore\n",
+			scene.FontSize, y, pdfString(s))
+	}
+	if scene.TopText != "" {
+		y := scene.MarginTop + scene.FontSize
+		if scene.TopLine {
+			line(y + 4)
+		}
+		text(scene.TopText, y)
+	}
+	if scene.BottomText != "" {
+		y := h - scene.MarginBottom
+		if scene.BottomLine {
+			line(y - scene.FontSize - 4)
+		}
+		text(scene.BottomText, y)
+	}
+
+	for _, shape := range scene.Shapes {
+		b.WriteString("gsave\n")
+		psClip(&b, scene, shape.Clip)
+		b.WriteString(psStrokeStyle(shape.Style))
+		color := pdfColor(shape.R, shape.G, shape.B)
+		paint := "stroke"
+		if shape.Fill {
+			paint = "gsave fill grestore stroke"
+		}
+
+		switch shape.Kind {
+		case "line":
+			start, end := shape.Points[0], shape.Points[1]
+			control := curveControl(start, end, scene.CurveStrength)
+			p0, ctrl, p1 := toFPoint(start), toFPoint(control), toFPoint(end)
+			c1, c2 := quadToCubic(p0, ctrl, p1)
+			fmt.Fprintf(&b, "%s setrgbcolor 2 setlinewidth %s %s moveto %s %s %s %s %s %s curveto stroke\n", color,
+				pdfNum(p0.X), pdfNum(p0.Y), pdfNum(c1.X), pdfNum(c1.Y), pdfNum(c2.X), pdfNum(c2.Y), pdfNum(p1.X), pdfNum(p1.Y))
+			polys := markerPolys(shape.Markers, p0, ctrl, p1, 2)
+			if len(polys) > 0 {
+				for _, poly := range polys {
+					b.WriteString(psPolygon(poly))
+				}
+				b.WriteString("fill\n")
+			}
+		case "circle":
+			c := toFPoint(shape.Points[0])
+			fmt.Fprintf(&b, "%s setrgbcolor 2 setlinewidth\n%s %s %d 0 360 arc closepath %s\n", color, pdfNum(c.X), pdfNum(c.Y), shape.Size, paint)
+		case "square":
+			p := shape.Points[0]
+			fmt.Fprintf(&b, "%s setrgbcolor 2 setlinewidth\n%s%s\n", color, rect(p.X, p.Y, shape.Size, shape.Size), paint)
+		case "polygon":
+			pts := make([]fpoint, len(shape.Points))
+			for i, p := range shape.Points {
+				pts[i] = toFPoint(p)
+			}
+			fmt.Fprintf(&b, "1 setlinewidth\n%sgsave %s setrgbcolor fill grestore 0 setgray stroke\n", psPolygon(pts), color)
+		}
+		b.WriteString("grestore\n")
+	}
+	return b.String()
+}
+
+// psClip intersects the clipping path with a clip region and its parents.
+func psClip(b *strings.Builder, scene *Scene, id int) {
+	if id == 0 || id > len(scene.Clips) {
+		return
+	}
+	region := scene.Clips[id-1]
+	psClip(b, scene, region.Parent)
+	switch region.Kind {
+	case "rect":
+		fmt.Fprintf(b, "%d %d moveto %d 0 rlineto 0 %d rlineto %d 0 rlineto closepath\n", region.X, region.Y, region.W, region.H, -region.W)
+	case "circle":
+		fmt.Fprintf(b, "%d %d %d 0 360 arc closepath\n", region.X, region.Y, region.R)
+	case "poly":
+		pts := make([]fpoint, len(region.Points))
+		for i, p := range region.Points {
+			pts[i] = toFPoint(p)
+		}
+		b.WriteString(psPolygon(pts))
+	case "margin":
+		fmt.Fprintf(b, "0 %d moveto %d 0 rlineto 0 %d rlineto %d 0 rlineto closepath\n",
+			scene.MarginTop, scene.Width, scene.Height-scene.MarginTop-scene.MarginBottom, -scene.Width)
+	}
+	b.WriteString("clip newpath\n")
+}
+
+// psStrokeStyle returns the dash, cap and join operators for a style. The
+// miter limit is set to SVG's default of 4.
+func psStrokeStyle(style StrokeStyle) string {
+	dash := make([]string, len(style.Dash))
+	for i, d := range style.Dash {
+		dash[i] = strconv.Itoa(d)
+	}
+	capStyle := map[string]int{"round": 1, "square": 2}[style.Cap]
+	joinStyle := map[string]int{"round": 1, "bevel": 2}[style.Join]
+	return fmt.Sprintf("[%s] 0 setdash %d setlinecap %d setlinejoin 4 setmiterlimit\n", strings.Join(dash, " "), capStyle, joinStyle)
+}
+
+func psPolygon(pts []fpoint) string {
+	var b strings.Builder
+	for i, p := range pts {
+		op := "lineto"
+		if i == 0 {
+			op = "moveto"
+		}
+		fmt.Fprintf(&b, "%s %s %s ", pdfNum(p.X), pdfNum(p.Y), op)
+	}
+	b.WriteString("closepath\n")
+	return b.String()
+}
+
+// dxfUnits maps the --units values to the DXF $INSUNITS codes. One canvas
+// unit becomes one drawing unit.
+var dxfUnits = map[string]int{
+	"none": 0,
+	"in":   1,
+	"ft":   2,
+	"mm":   4,
+	"cm":   5,
+	"m":    6,
+}
+
+// dxfWriter builds an AutoCAD R2000 (AC1015) DXF file. Every object gets
+// a handle, and entities belong to the model space block record.
+type dxfWriter struct {
+	b       strings.Builder
+	handle  int
+	height  int
+	modelBR string // handle of the *Model_Space block record
+}
+
+func (d *dxfWriter) pair(code int, value string) {
+	fmt.Fprintf(&d.b, "%3d\n%s\n", code, value)
+}
+
+func (d *dxfWriter) num(code int, f float64) {
+	d.pair(code, pdfNum(f))
+}
+
+func (d *dxfWriter) next() string {
+	d.handle++
+	return fmt.Sprintf("%X", d.handle)
+}
+
+// point writes an x, y pair flipped to DXF's y-up coordinates.
+func (d *dxfWriter) point(code int, p fpoint) {
+	d.num(code, p.X)
+	d.num(code+10, float64(d.height)-p.Y)
+	d.num(code+20, 0)
+}
+
+// table writes a symbol table with handle h (a new one if empty) and the
+// given entries. Each entry writes its own fields after the common ones.
+func (d *dxfWriter) table(name, h string, entries ...func(owner string)) {
+	if h == "" {
+		h = d.next()
+	}
+	d.pair(0, "TABLE")
+	d.pair(2, name)
+	d.pair(5, h)
+	d.pair(330, "0")
+	d.pair(100, "AcDbSymbolTable")
+	d.pair(70, strconv.Itoa(len(entries)))
+	for _, entry := range entries {
+		entry(h)
+	}
+	d.pair(0, "ENDTAB")
+}
+
+// record starts a symbol table entry with handle h (a new one if empty).
+func (d *dxfWriter) record(kind, subclass, name, h, owner string) {
+	if h == "" {
+		h = d.next()
+	}
+	d.pair(0, kind)
+	d.pair(5, h)
+	d.pair(330, owner)
+	d.pair(100, "AcDbSymbolTableRecord")
+	d.pair(100, subclass)
+	d.pair(2, name)
+	d.pair(70, "0")
+}
+
+// entity starts an entity on layer.
+func (d *dxfWriter) entity(kind, layer, subclass string) {
+	d.pair(0, kind)
+	d.pair(5, d.next())
+	d.pair(330, d.modelBR)
+	d.pair(100, "AcDbEntity")
+	d.pair(8, layer)
+	d.pair(100, subclass)
+}
+
+func (d *dxfWriter) line(layer string, a, b fpoint) {
+	d.entity("LINE", layer, "AcDbLine")
+	d.point(10, a)
+	d.point(11, b)
+}
+
+func (d *dxfWriter) polyline(layer string, pts []fpoint, closed bool) {
+	d.entity("LWPOLYLINE", layer, "AcDbPolyline")
+	d.pair(90, strconv.Itoa(len(pts)))
+	if closed {
+		d.pair(70, "1")
+	} else {
+		d.pair(70, "0")
+	}
+	for _, p := range pts {
+		d.num(10, p.X)
+		d.num(20, float64(d.height)-p.Y)
+	}
+}
+
+// dxfLayer names the layer for a color. Layers are per color so CAD users
+// can pick out everything drawn in one color.
+func dxfLayer(r, g, b int) string {
+	return fmt.Sprintf("RGB_%d_%d_%d", r, g, b)
+}
+
+// dxfACI returns the closest of the basic AutoCAD color indexes, used by
+// readers that ignore true color. Black and white are both index 7.
+func dxfACI(r, g, b int) int {
+	colors := [][3]int{{255, 0, 0}, {255, 255, 0}, {0, 255, 0}, {0, 255, 255}, {0, 0, 255},
+		{255, 0, 255}, {255, 255, 255}, {128, 128, 128}, {192, 192, 192}}
+	if r+g+b < 3*64 {
+		return 7
+	}
+	best, bestDist := 7, -1
+	for i, c := range colors {
+		dist := (r-c[0])*(r-c[0]) + (g-c[1])*(g-c[1]) + (b-c[2])*(b-c[2])
+		if bestDist < 0 || dist < bestDist {
+			best, bestDist = i+1, dist
+		}
+	}
+	return best
+}
+
+// writeDXF writes a scene as a DXF drawing in y-up canvas coordinates with
+// one layer per color. Lines become LINE or, when curved, a degree 2
+// SPLINE; circles CIRCLE; squares and polygons closed LWPOLYLINE; text
+// TEXT. Markers are written as closed polylines. DXF has no fills, dashes
+// or clipping here, so those are left out. With optimize the lines are
+// written in the order dxfLineOrder finds, for laser cutters and plotters
+// that follow the entity order.
+func writeDXF(w io.Writer, scene *Scene, units string, optimize bool) error {
+	code, ok := dxfUnits[units]
+	if !ok {
+		return fmt.Errorf("Unknown DXF units %q", units)
+	}
+
+	// Entities first, so the tables know every layer. Handles 1-3 are the
+	// block record table and the model and paper space records, the rest
+	// are numbered from 10 on in the order they are written.
+	ents := &dxfWriter{handle: 0xF, height: scene.Height, modelBR: "2"}
+	type layerColor struct{ r, g, b int }
+	var layers []layerColor
+	seen := make(map[layerColor]bool)
+	layer := func(r, g, b int) string {
+		c := layerColor{r, g, b}
+		if !seen[c] {
+			seen[c] = true
+			layers = append(layers, c)
 		}
+		return dxfLayer(r, g, b)
+	}
 
-		if strings.HasPrefix(line, "LRFILL") && isV2 {
-			parts := strings.Fields(line)
-			if len(parts) == 2 {
-				val := strings.ToUpper(parts[1])
-				if val == "ON" {
-					fillMode = true
-					if *verbose {
-						fmt.Println("Fill mode enabled")
-					}
-				} else if val == "OFF" {
-					fillMode = false
-					if *verbose {
-						fmt.Println("Fill mode disabled")
-					}
-				}
-			}
-			continue
+	text := func(s string, y int) {
+		ents.entity("TEXT", layer(0, 0, 0), "AcDbText")
+		ents.point(10, fpoint{10, float64(y)})
+		ents.num(40, float64(scene.FontSize))
+		ents.pair(1, s)
+		ents.pair(100, "AcDbText")
+	}
+	if scene.TopText != "" {
+		y := scene.MarginTop + scene.FontSize
+		if scene.TopLine {
+			ents.line(layer(0, 0, 0), fpoint{0, float64(y + 4)}, fpoint{float64(scene.Width), float64(y + 4)})
 		}
+		text(scene.TopText, y)
+	}
+	if scene.BottomText != "" {
+		y := scene.Height - scene.MarginBottom
+		if scene.BottomLine {
+			ly := float64(y - scene.FontSize - 4)
+			ents.line(layer(0, 0, 0), fpoint{0, ly}, fpoint{float64(scene.Width), ly})
+		}
+		text(scene.BottomText, y)
+	}
 
-		// Handle circles and squares for v2
-		if isV2 && strings.HasPrefix(line, "LRCIRCLE") {
-			// Format: LRCIRCLE x,y,radius..r,g,b
-			parts := strings.SplitN(line, " ", 2)
-			if len(parts) < 2 {
-				if *verbose {
-					fmt.Println("Skipping malformed LRCIRCLE line")
+	shapes := scene.Shapes
+	if optimize {
+		shapes = dxfLineOrder(scene)
+	}
+	for _, shape := range shapes {
+		name := layer(shape.R, shape.G, shape.B)
+		switch shape.Kind {
+		case "line":
+			start, end := shape.Points[0], shape.Points[1]
+			control := curveControl(start, end, scene.CurveStrength)
+			p0, ctrl, p1 := toFPoint(start), toFPoint(control), toFPoint(end)
+			if scene.CurveStrength == 0 {
+				ents.line(name, p0, p1)
+			} else {
+				ents.entity("SPLINE", name, "AcDbSpline")
+				ents.pair(210, "0")
+				ents.pair(220, "0")
+				ents.pair(230, "1")
+				ents.pair(70, "8") // planar
+				ents.pair(71, "2") // degree
+				ents.pair(72, "6") // knots
+				ents.pair(73, "3") // control points
+				ents.pair(74, "0") // fit points
+				for _, k := range []string{"0", "0", "0", "1", "1", "1"} {
+					ents.pair(40, k)
 				}
-				continue
-			}
-			params := parts[1]
-			colorR, colorG, colorB := 0, 0, 0
-			if strings.Contains(params, "..") {
-				subparts := strings.Split(params, "..")
-				params = subparts[0]
-				rgbParts := strings.Split(subparts[1], ",")
-				if len(rgbParts) == 3 {
-					colorR, _ = strconv.Atoi(rgbParts[0])
-					colorG, _ = strconv.Atoi(rgbParts[1])
-					colorB, _ = strconv.Atoi(rgbParts[2])
+				for _, p := range []fpoint{p0, ctrl, p1} {
+					ents.point(10, p)
 				}
 			}
-			vals := strings.Split(params, ",")
-			if len(vals) != 3 {
-				if *verbose {
-					fmt.Println("Skipping malformed LRCIRCLE parameters")
-				}
-				continue
+			for _, poly := range markerPolys(shape.Markers, p0, ctrl, p1, 2) {
+				ents.polyline(name, poly, true)
 			}
-			x, _ := strconv.Atoi(vals[0])
-			y, _ := strconv.Atoi(vals[1])
-			radius, _ := strconv.Atoi(vals[2])
-			y = height - y // invert y
-
-			fillAttr := "none"
-			if fillMode {
-				fillAttr = fmt.Sprintf("rgb(%d,%d,%d)", colorR, colorG, colorB)
+		case "circle":
+			ents.entity("CIRCLE", name, "AcDbCircle")
+			ents.point(10, toFPoint(shape.Points[0]))
+			ents.num(40, float64(shape.Size))
+		case "square":
+			p, n := toFPoint(shape.Points[0]), float64(shape.Size)
+			ents.polyline(name, []fpoint{p, {p.X + n, p.Y}, {p.X + n, p.Y + n}, {p.X, p.Y + n}}, true)
+		case "polygon":
+			pts := make([]fpoint, len(shape.Points))
+			for i, p := range shape.Points {
+				pts[i] = toFPoint(p)
 			}
-			strokeAttr := fmt.Sprintf("rgb(%d,%d,%d)", colorR, colorG, colorB)
+			ents.polyline(name, pts, true)
+		}
+	}
 
-			paths = append(paths,
-				       fmt.Sprintf(`<circle cx="%d" cy="%d" r="%d" fill="%s" stroke="%s" stroke-width="2"/>`,
-						   x, y, radius, fillAttr, strokeAttr))
-			if *verbose {
-				fmt.Printf("Added circle at (%d,%d) radius %d color rgb(%d,%d,%d) fillMode %v\n",
-					   x, y, radius, colorR, colorG, colorB, fillMode)
-			}
-			continue
+	d := &dxfWriter{handle: ents.handle, height: scene.Height}
+	d.pair(0, "SECTION")
+	d.pair(2, "TABLES")
+	d.table("VPORT", "")
+	d.table("LTYPE", "", func(owner string) {
+		for _, name := range []string{"ByBlock", "ByLayer", "Continuous"} {
+			d.record("LTYPE", "AcDbLinetypeTableRecord", name, "", owner)
+			d.pair(3, "")
+			d.pair(72, "65")
+			d.pair(73, "0")
+			d.pair(40, "0")
 		}
+	})
+	layerEntries := []func(string){func(owner string) {
+		d.record("LAYER", "AcDbLayerTableRecord", "0", "", owner)
+		d.pair(62, "7")
+		d.pair(6, "Continuous")
+	}}
+	for _, c := range layers {
+		c := c
+		layerEntries = append(layerEntries, func(owner string) {
+			d.record("LAYER", "AcDbLayerTableRecord", dxfLayer(c.r, c.g, c.b), "", owner)
+			d.pair(62, strconv.Itoa(dxfACI(c.r, c.g, c.b)))
+			d.pair(420, strconv.Itoa(c.r<<16|c.g<<8|c.b))
+			d.pair(6, "Continuous")
+		})
+	}
+	d.table("LAYER", "", layerEntries...)
+	d.table("STYLE", "", func(owner string) {
+		d.record("STYLE", "AcDbTextStyleTableRecord", "Standard", "", owner)
+		d.pair(40, "0")
+		d.pair(41, "1")
+		d.pair(50, "0")
+		d.pair(71, "0")
+		d.pair(42, "2.5")
+		d.pair(3, "txt")
+		d.pair(4, "")
+	})
+	d.table("VIEW", "")
+	d.table("UCS", "")
+	d.table("APPID", "", func(owner string) {
+		d.record("APPID", "AcDbRegAppTableRecord", "ACAD", "", owner)
+	})
+	d.table("DIMSTYLE", "")
+	d.table("BLOCK_RECORD", "1", func(owner string) {
+		d.record("BLOCK_RECORD", "AcDbBlockTableRecord", "*Model_Space", "2", owner)
+	}, func(owner string) {
+		d.record("BLOCK_RECORD", "AcDbBlockTableRecord", "*Paper_Space", "3", owner)
+	})
+	d.pair(0, "ENDSEC")
 
-		if isV2 && strings.HasPrefix(line, "LRSQUARE") {
-			// Format: LRSQUARE x,y,size..r,g,b
-			parts := strings.SplitN(line, " ", 2)
-			if len(parts) < 2 {
-				if *verbose {
-					fmt.Println("Skipping malformed LRSQUARE line")
-				}
-				continue
-			}
-			params := parts[1]
-			colorR, colorG, colorB := 0, 0, 0
-			if strings.Contains(params, "..") {
-				subparts := strings.Split(params, "..")
-				params = subparts[0]
-				rgbParts := strings.Split(subparts[1], ",")
-				if len(rgbParts) == 3 {
-					colorR, _ = strconv.Atoi(rgbParts[0])
-					colorG, _ = strconv.Atoi(rgbParts[1])
-					colorB, _ = strconv.Atoi(rgbParts[2])
-				}
+	d.pair(0, "SECTION")
+	d.pair(2, "BLOCKS")
+	for i, name := range []string{"*Model_Space", "*Paper_Space"} {
+		owner := strconv.Itoa(2 + i)
+		for _, kind := range []string{"BLOCK", "ENDBLK"} {
+			d.pair(0, kind)
+			d.pair(5, d.next())
+			d.pair(330, owner)
+			d.pair(100, "AcDbEntity")
+			if i == 1 {
+				d.pair(67, "1")
 			}
-			vals := strings.Split(params, ",")
-			if len(vals) != 3 {
-				if *verbose {
-					fmt.Println("Skipping malformed LRSQUARE parameters")
-				}
+			d.pair(8, "0")
+			if kind == "ENDBLK" {
+				d.pair(100, "AcDbBlockEnd")
 				continue
 			}
-			x, _ := strconv.Atoi(vals[0])
-			y, _ := strconv.Atoi(vals[1])
-			size, _ := strconv.Atoi(vals[2])
-			y = height - y // invert y
+			d.pair(100, "AcDbBlockBegin")
+			d.pair(2, name)
+			d.pair(70, "0")
+			d.point(10, fpoint{0, float64(scene.Height)})
+			d.pair(3, name)
+			d.pair(1, "")
+		}
+	}
+	d.pair(0, "ENDSEC")
 
-			fillAttr := "none"
-			if fillMode {
-				fillAttr = fmt.Sprintf("rgb(%d,%d,%d)", colorR, colorG, colorB)
-			}
-			strokeAttr := fmt.Sprintf("rgb(%d,%d,%d)", colorR, colorG, colorB)
+	d.pair(0, "SECTION")
+	d.pair(2, "ENTITIES")
+	d.b.WriteString(ents.b.String())
+	d.pair(0, "ENDSEC")
 
-			paths = append(paths,
-				       fmt.Sprintf(`<rect x="%d" y="%d" width="%d" height="%d" fill="%s" stroke="%s" stroke-width="2"/>`,
-						   x, y-size, size, size, fillAttr, strokeAttr))
-			if *verbose {
-				fmt.Printf("Added square at (%d,%d) size %d color rgb(%d,%d,%d) fillMode %v\n",
-					   x, y, size, colorR, colorG, colorB, fillMode)
-			}
+	// The named object dictionary, with the ACAD_GROUP dictionary AutoCAD
+	// expects in it.
+	root, groups := d.next(), d.next()
+	d.pair(0, "SECTION")
+	d.pair(2, "OBJECTS")
+	d.pair(0, "DICTIONARY")
+	d.pair(5, root)
+	d.pair(330, "0")
+	d.pair(100, "AcDbDictionary")
+	d.pair(281, "1")
+	d.pair(3, "ACAD_GROUP")
+	d.pair(350, groups)
+	d.pair(0, "DICTIONARY")
+	d.pair(5, groups)
+	d.pair(330, root)
+	d.pair(100, "AcDbDictionary")
+	d.pair(281, "1")
+	d.pair(0, "ENDSEC")
+	d.pair(0, "EOF")
+
+	// The header goes last as it needs the next free handle.
+	header := &dxfWriter{height: scene.Height}
+	header.pair(0, "SECTION")
+	header.pair(2, "HEADER")
+	header.pair(9, "$ACADVER")
+	header.pair(1, "AC1015")
+	header.pair(9, "$HANDSEED")
+	header.pair(5, fmt.Sprintf("%X", d.handle+1))
+	header.pair(9, "$INSUNITS")
+	header.pair(70, strconv.Itoa(code))
+	header.pair(9, "$EXTMIN")
+	header.point(10, fpoint{0, float64(scene.Height)})
+	header.pair(9, "$EXTMAX")
+	header.point(10, fpoint{float64(scene.Width), 0})
+	header.pair(0, "ENDSEC")
+
+	_, err := io.WriteString(w, header.b.String()+d.b.String())
+	return err
+}
+
+// dxfLineOrder returns the scene's shapes with the lines of each color
+// ordered by optimizeStrokes, color by color, followed by the other
+// shapes. Lines are not merged as for the plotter, so each stays its own
+// entity and curves stay splines; a line drawn backwards gets its points
+// and markers swapped, which gives the same curve. The source order is
+// kept if it has less travel.
+func dxfLineOrder(scene *Scene) []Shape {
+	type lineKey struct {
+		r, g, b    int
+		start, end fpoint
+	}
+	var paths []plotPath
+	var others []Shape
+	lines := make(map[lineKey][]Shape)
+	for _, sh := range scene.Shapes {
+		if sh.Kind != "line" {
+			others = append(others, sh)
 			continue
 		}
+		p0, p1 := toFPoint(sh.Points[0]), toFPoint(sh.Points[1])
+		paths = append(paths, plotPath{R: sh.R, G: sh.G, B: sh.B, Points: []fpoint{p0, p1}})
+		key := lineKey{sh.R, sh.G, sh.B, p0, p1}
+		lines[key] = append(lines[key], sh)
+	}
 
-		// The rest is line parsing like before:
+	origin := fpoint{0, float64(scene.Height)}
+	pens := penOrder(paths)
+	optimized := make([][]plotPath, len(pens))
+	pos := origin
+	for i, pen := range pens {
+		optimized[i] = optimizeStrokes(pen, pos)
+		pos = optimized[i][len(optimized[i])-1].Points[1]
+	}
+	if plotTravel(optimized, origin) >= plotTravel(pens, origin) {
+		return scene.Shapes
+	}
 
-		colorR, colorG, colorB := 0, 0, 0
-		if strings.Contains(line, "..") {
-			parts := strings.Split(line, "..")
-			line = parts[0]
-			rgbParts := strings.Split(parts[1], ",")
-			if len(rgbParts) == 3 {
-				colorR, _ = strconv.Atoi(rgbParts[0])
-				colorG, _ = strconv.Atoi(rgbParts[1])
-				colorB, _ = strconv.Atoi(rgbParts[2])
+	shapes := make([]Shape, 0, len(scene.Shapes))
+	for _, pen := range optimized {
+		for _, p := range pen {
+			key := lineKey{p.R, p.G, p.B, p.Points[0], p.Points[1]}
+			flip := len(lines[key]) == 0
+			if flip {
+				key.start, key.end = key.end, key.start
 			}
-		}
-
-		parts := strings.Split(line, ",")
-		if len(parts) != 4 {
-			if *verbose {
-				fmt.Printf("Skipping malformed line: %s\n", line)
+			sh := lines[key][0]
+			lines[key] = lines[key][1:]
+			if flip {
+				sh.Points = []Point{sh.Points[1], sh.Points[0]}
+				sh.Markers = LineMarkers{Start: sh.Markers.End, End: sh.Markers.Start}
 			}
-			continue
+			shapes = append(shapes, sh)
 		}
+	}
+	return append(shapes, others...)
+}
 
-		x1, _ := strconv.Atoi(parts[0])
-		y1, _ := strconv.Atoi(parts[1])
-		x2, _ := strconv.Atoi(parts[2])
-		y2, _ := strconv.Atoi(parts[3])
+// plotOptions are the pen plotter settings for G-code and HPGL output.
+type plotOptions struct {
+	Scale     float64 // millimetres per canvas unit
+	Tolerance float64 // largest distance in mm between a curve and its polyline
+	Feed      float64 // drawing speed in mm/min
+	PenUp     string  // G-code that lifts the pen
+	PenDown   string  // G-code that lowers the pen
+	PenChange string  // G-code template for a pen change, see penChange
+	Optimize  bool    // reorder and merge strokes to cut pen-up travel
+	Hatch     float64 // spacing in mm of the hatch lines for fills, 0 for none
+	HatchAng  float64 // angle of the hatch lines in degrees, counter-clockwise
+}
 
-		y1 = height - y1
-		y2 = height - y2
+// plotPath is one pen stroke for the plotter writers, in canvas
+// coordinates.
+type plotPath struct {
+	R, G, B int
+	Points  []fpoint
+}
 
-		coloredLines = append(coloredLines, ColoredLine{
-			Start: Point{x1, y1},
-			End:   Point{x2, y2},
-			R:     colorR,
-			G:     colorG,
-			B:     colorB,
-		})
+// plotPaths turns a scene into pen strokes. Curves and circles are
+// flattened so no point is further than the tolerance from the real shape,
+// closed shapes end where they start and dash patterns lift the pen.
+// Polygons are outlined in black as in the SVG. Fills become hatch lines
+// when opts.Hatch is set and are left out otherwise, as is text.
+func plotPaths(scene *Scene, opts plotOptions) []plotPath {
+	tol := opts.Tolerance / opts.Scale
+	var paths []plotPath
+	hatch := func(r, g, b int, pts []fpoint) {
+		if opts.Hatch > 0 {
+			for _, seg := range hatchLines(pts, opts.Hatch/opts.Scale, opts.HatchAng) {
+				paths = append(paths, plotPath{r, g, b, seg})
+			}
+		}
 	}
-
-	if err := scanner.Err(); err != nil {
-		log.Fatalf("Error reading file: %v", err)
+	add := func(r, g, b int, pts []fpoint, closed bool, dash []int) {
+		if closed {
+			pts = append(append([]fpoint{}, pts...), pts[0])
+		}
+		pieces := [][]fpoint{pts}
+		total := 0
+		for _, d := range dash {
+			total += d
+		}
+		if total > 0 {
+			on := make([]float64, len(dash))
+			for i, d := range dash {
+				on[i] = float64(d)
+			}
+			pieces = dashPolyline(pts, false, on)
+		}
+		for _, piece := range pieces {
+			if len(piece) > 1 {
+				paths = append(paths, plotPath{r, g, b, piece})
+			}
+		}
 	}
 
-	// Group and process lines
-	groups := make(map[string][]ColoredLine)
-	for _, line := range coloredLines {
-		key := fmt.Sprintf("%d,%d,%d", line.R, line.G, line.B)
-		groups[key] = append(groups[key], line)
+	if scene.TopText != "" && scene.TopLine {
+		y := float64(scene.MarginTop + scene.FontSize + 4)
+		add(0, 0, 0, []fpoint{{0, y}, {float64(scene.Width), y}}, false, nil)
+	}
+	if scene.BottomText != "" && scene.BottomLine {
+		y := float64(scene.Height - scene.MarginBottom - scene.FontSize - 4)
+		add(0, 0, 0, []fpoint{{0, y}, {float64(scene.Width), y}}, false, nil)
 	}
 
-	for key, lines := range groups {
-		if len(lines) < 4 {
-			for _, l := range lines {
-				paths = append(paths, curveLine(l.Start, l.End, curveStrength, l.R, l.G, l.B))
+	for _, shape := range scene.Shapes {
+		switch shape.Kind {
+		case "line":
+			start, end := shape.Points[0], shape.Points[1]
+			control := curveControl(start, end, scene.CurveStrength)
+			p0, ctrl, p1 := toFPoint(start), toFPoint(control), toFPoint(end)
+			// A quadratic curve strays at most |p0-2ctrl+p1|/(4n²) from
+			// its chords when split into n equal steps.
+			bend := math.Hypot(p0.X-2*ctrl.X+p1.X, p0.Y-2*ctrl.Y+p1.Y)
+			n := int(math.Ceil(math.Sqrt(bend / (4 * tol))))
+			if n < 1 {
+				n = 1
 			}
-			continue
-		}
-
-		used := make([]bool, len(lines))
-		var chain []Point
-		current := lines[0].Start
-		chain = append(chain, current)
-		used[0] = true
-		found := 1
-
-		for found < 4 {
-			madeProgress := false
-			for i, l := range lines {
-				if used[i] {
-					continue
-				}
-				if l.Start == current {
-					chain = append(chain, l.End)
-					current = l.End
-					used[i] = true
-					found++
-					madeProgress = true
-					break
-				} else if l.End == current {
-					chain = append(chain, l.Start)
-					current = l.Start
-					used[i] = true
-					found++
-					madeProgress = true
-					break
-				}
+			add(shape.R, shape.G, shape.B, quadPoints(p0, ctrl, p1, n), false, shape.Style.Dash)
+			for _, poly := range markerPolys(shape.Markers, p0, ctrl, p1, 2) {
+				add(shape.R, shape.G, shape.B, poly, true, nil)
 			}
-			if !madeProgress {
-				break
+		case "circle":
+			r := float64(shape.Size)
+			n := 8
+			if tol < r {
+				n = max(n, int(math.Ceil(math.Pi/math.Acos(1-tol/r))))
+			}
+			pts := circleSegments(toFPoint(shape.Points[0]), r, n)
+			if shape.Fill {
+				hatch(shape.R, shape.G, shape.B, pts)
+			}
+			add(shape.R, shape.G, shape.B, pts, true, shape.Style.Dash)
+		case "square":
+			n := float64(shape.Size)
+			pts := rectPoints(toFPoint(shape.Points[0]), n, n)
+			if shape.Fill {
+				hatch(shape.R, shape.G, shape.B, pts)
 			}
+			add(shape.R, shape.G, shape.B, pts, true, shape.Style.Dash)
+		case "polygon":
+			pts := make([]fpoint, len(shape.Points))
+			for i, p := range shape.Points {
+				pts[i] = toFPoint(p)
+			}
+			hatch(shape.R, shape.G, shape.B, pts)
+			add(0, 0, 0, pts, true, shape.Style.Dash)
 		}
+	}
+	return paths
+}
 
-		// Close loop and check
-		chain = append(chain, chain[0])
-		if len(chain) == 5 && chain[0] == chain[4] {
-			pointsStr := ""
-			for i := 0; i < 4; i++ {
-				pointsStr += fmt.Sprintf("%d,%d ", chain[i].X, chain[i].Y)
+// hatchLines fills a polygon with parallel lines spacing canvas units
+// apart at angle degrees, counter-clockwise from the x axis with y up as
+// on paper. The lines lie on a grid through the canvas origin, so shapes
+// next to each other get lines that continue across them. Consecutive
+// lines run in opposite directions.
+func hatchLines(poly []fpoint, spacing, angle float64) [][]fpoint {
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	// Canvas y points down, so the line direction is (cos, -sin) and the
+	// offset of each line is measured along the normal (sin, cos).
+	along := func(p fpoint) float64 { return p.X*cos - p.Y*sin }
+	across := func(p fpoint) float64 { return p.X*sin + p.Y*cos }
+
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, p := range poly {
+		lo = math.Min(lo, across(p))
+		hi = math.Max(hi, across(p))
+	}
+	var lines [][]fpoint
+	for k := math.Floor(lo/spacing) + 0.5; k*spacing < hi; k++ {
+		c := k * spacing
+		var hits []float64
+		for i, a := range poly {
+			b := poly[(i+1)%len(poly)]
+			ta, tb := across(a), across(b)
+			if (ta <= c) == (tb <= c) {
+				continue
 			}
-			fillColor := fmt.Sprintf("rgb(%s)", key)
-			if isV2 {
-				if fillMode {
-					paths = append(paths, fmt.Sprintf(
-						`<polygon points="%s" fill="%s" stroke="black" stroke-width="1"/>`,
-				       strings.TrimSpace(pointsStr), fillColor))
-				} else {
-					// Just stroke lines
-					for _, l := range lines {
-						paths = append(paths, curveLine(l.Start, l.End, curveStrength, l.R, l.G, l.B))
-					}
-				}
-			} else {
-				// V1 always fill
-				paths = append(paths, fmt.Sprintf(
-					`<polygon points="%s" fill="%s" stroke="black" stroke-width="1"/>`,
-				      strings.TrimSpace(pointsStr), fillColor))
+			t := (c - ta) / (tb - ta)
+			hits = append(hits, along(fpoint{a.X + t*(b.X-a.X), a.Y + t*(b.Y-a.Y)}))
+		}
+		sort.Float64s(hits)
+		if len(lines)%2 == 1 {
+			for i, j := 0, len(hits)-1; i < j; i, j = i+1, j-1 {
+				hits[i], hits[j] = hits[j], hits[i]
 			}
-		} else {
-			for _, l := range lines {
-				paths = append(paths, curveLine(l.Start, l.End, curveStrength, l.R, l.G, l.B))
+		}
+		// Points on the line are u*(cos, -sin) + c*(sin, cos).
+		point := func(u float64) fpoint {
+			return fpoint{u*cos + c*sin, -u*sin + c*cos}
+		}
+		for i := 0; i+1 < len(hits); i += 2 {
+			if hits[i] != hits[i+1] {
+				lines = append(lines, []fpoint{point(hits[i]), point(hits[i+1])})
 			}
 		}
 	}
+	return lines
+}
 
-	baseName := strings.TrimSuffix(filepath.Base(*filepathFlag), filepath.Ext(*filepathFlag))
-	svgName := baseName + ".svg"
-	jpgName := baseName + ".jpg"
+// plotPens returns the scene's strokes grouped into pens. With
+// opts.Optimize the strokes of each pen are merged and reordered to cut
+// down on pen-up travel, and the travel before and after is reported.
+func plotPens(scene *Scene, opts plotOptions) [][]plotPath {
+	pens := penOrder(plotPaths(scene, opts))
+	if !opts.Optimize {
+		return pens
+	}
+	origin := fpoint{0, float64(scene.Height)}
+	before := plotTravel(pens, origin)
+	optimized := make([][]plotPath, len(pens))
+	pos := origin
+	for i, pen := range pens {
+		optimized[i] = optimizeStrokes(mergeStrokes(pen), pos)
+		last := optimized[i][len(optimized[i])-1].Points
+		pos = last[len(last)-1]
+	}
+	// Greedy ordering gives no guarantee; keep the source order if it
+	// happens to be better.
+	after := plotTravel(optimized, origin)
+	if after < before {
+		pens = optimized
+	} else {
+		after = before
+	}
+	saved := 0.0
+	if before > 0 {
+		saved = 100 * (before - after) / before
+	}
+	fmt.Fprintf(logOut, "Plotter travel %.1f mm before and %.1f mm after optimization (%.0f%% less)\n",
+		before*opts.Scale, after*opts.Scale, saved)
+	return pens
+}
 
-	// Write SVG
-	output, err := os.Create(svgName)
-	if err != nil {
-		log.Fatalf("Failed to create %s: %v", svgName, err)
+// plotTravel returns the pen-up distance needed to draw pens in order,
+// starting at start.
+func plotTravel(pens [][]plotPath, start fpoint) float64 {
+	travel := 0.0
+	pos := start
+	for _, pen := range pens {
+		for _, p := range pen {
+			travel += fdist(pos, p.Points[0])
+			pos = p.Points[len(p.Points)-1]
+		}
 	}
-	defer output.Close()
+	return travel
+}
 
-	fmt.Fprintf(output, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d">`+"\n", width, height)
-	fmt.Fprintf(output, `<rect width="%d" height="%d" fill="white"/>`+"\n", width, height)
+func fdist(a, b fpoint) float64 {
+	return math.Hypot(a.X-b.X, a.Y-b.Y)
+}
 
-	if topText != "" {
-		y := marginTop + fontSize
-		if topLine {
-			fmt.Fprintf(output, `<line x1="0" y1="%d" x2="%d" y2="%d" stroke="black" stroke-width="1"/>`+"\n", y+4, width, y+4)
+// mergeStrokes joins strokes that share an end point into longer ones,
+// reversing them where needed, so the pen stays down across the joint.
+// Strokes are followed from the first unused one in both directions.
+func mergeStrokes(paths []plotPath) []plotPath {
+	// End points are matched on a grid fine enough to absorb the rounding
+	// of flattened curves.
+	key := func(p fpoint) [2]int64 {
+		return [2]int64{int64(math.Round(p.X * 1000)), int64(math.Round(p.Y * 1000))}
+	}
+	ends := make(map[[2]int64][]int)
+	for i, p := range paths {
+		ends[key(p.Points[0])] = append(ends[key(p.Points[0])], i)
+		last := p.Points[len(p.Points)-1]
+		ends[key(last)] = append(ends[key(last)], i)
+	}
+	used := make([]bool, len(paths))
+	// next returns the points of an unused stroke that starts at p, taking
+	// it out of the pool.
+	next := func(p fpoint) []fpoint {
+		for _, j := range ends[key(p)] {
+			if used[j] {
+				continue
+			}
+			used[j] = true
+			pts := paths[j].Points
+			if key(pts[0]) == key(p) {
+				return pts
+			}
+			return reversePoints(pts)
 		}
-		fmt.Fprintf(output, `<text x="10" y="%d" font-size="%d" fill="black">%s</text>`+"\n", y, fontSize, topText)
+		return nil
 	}
 
-	if bottomText != "" {
-		y := height - marginBottom
-		if bottomLine {
-			fmt.Fprintf(output, `<line x1="0" y1="%d" x2="%d" y2="%d" stroke="black" stroke-width="1"/>`+"\n", y-fontSize-4, width, y-fontSize-4)
+	var merged []plotPath
+	for i, p := range paths {
+		if used[i] {
+			continue
+		}
+		used[i] = true
+		pts := append([]fpoint{}, p.Points...)
+		for more := next(pts[len(pts)-1]); more != nil; more = next(pts[len(pts)-1]) {
+			pts = append(pts, more[1:]...)
 		}
-		fmt.Fprintf(output, `<text x="10" y="%d" font-size="%d" fill="black">%s</text>`+"\n", y, fontSize, bottomText)
+		for more := next(pts[0]); more != nil; more = next(pts[0]) {
+			pts = append(reversePoints(more), pts[1:]...)
+		}
+		merged = append(merged, plotPath{p.R, p.G, p.B, pts})
 	}
+	return merged
+}
 
-	for _, path := range paths {
-		fmt.Fprintln(output, path)
+func reversePoints(pts []fpoint) []fpoint {
+	rev := make([]fpoint, len(pts))
+	for i, p := range pts {
+		rev[len(pts)-1-i] = p
 	}
+	return rev
+}
 
-	fmt.Fprintln(output, `</svg>`)
-	fmt.Printf("Generated %s successfully\n", svgName)
-
-	// JPG conversion
-	if !*nojpg {
-		if checkCommand("rsvg-convert") {
-			err = exec.Command("rsvg-convert", "-o", jpgName, svgName).Run()
-		} else if checkCommand("convert") {
-			err = exec.Command("convert", svgName, jpgName).Run()
-		} else {
-			fmt.Println("No rsvg-convert binary found!")
-			os.Exit(1)
-			return
-		}
+// maxTwoOpt is the largest number of strokes of one pen that 2-opt is
+// run on; it takes time quadratic in the count for every pass.
+const maxTwoOpt = 2000
 
-		if err != nil {
-			log.Printf("JPG conversion failed with error: %v", err)
-			os.Exit(1)
-		} else {
-			fmt.Printf("Generated %s successfully.\n", jpgName)
+// optimizeStrokes orders strokes to keep pen-up travel short, starting at
+// start. Each step goes to the nearest free stroke end, drawing the
+// stroke backwards when its end is the nearer one. The order is then
+// improved with 2-opt, which reverses runs of strokes while that
+// shortens the travel.
+func optimizeStrokes(paths []plotPath, start fpoint) []plotPath {
+	order := make([]plotPath, 0, len(paths))
+	used := make([]bool, len(paths))
+	pos := start
+	for range paths {
+		best, bestDist, flip := -1, math.Inf(1), false
+		for i, p := range paths {
+			if used[i] {
+				continue
+			}
+			if d := fdist(pos, p.Points[0]); d < bestDist {
+				best, bestDist, flip = i, d, false
+			}
+			if d := fdist(pos, p.Points[len(p.Points)-1]); d < bestDist {
+				best, bestDist, flip = i, d, true
+			}
+		}
+		used[best] = true
+		p := paths[best]
+		if flip {
+			p.Points = reversePoints(p.Points)
 		}
+		order = append(order, p)
+		pos = p.Points[len(p.Points)-1]
+	}
+	if len(order) > maxTwoOpt {
+		return order
 	}
 
-	if *nosvg {
-		err := os.Remove(svgName)
-		if err != nil {
-			log.Printf("Failed to remove SVG file: %v", err)
-			os.Exit(1)
-		} else {
-			fmt.Printf("Removed %s SVG file\n", svgName)
+	first := func(i int) fpoint { return order[i].Points[0] }
+	last := func(i int) fpoint { return order[i].Points[len(order[i].Points)-1] }
+	for improved := true; improved; {
+		improved = false
+		for i := range order {
+			prev := start
+			if i > 0 {
+				prev = last(i - 1)
+			}
+			for j := i + 1; j < len(order); j++ {
+				// Reversing order[i..j] drawn backwards only changes the
+				// moves into i and out of j.
+				old := fdist(prev, first(i))
+				gain := fdist(prev, last(j))
+				if j+1 < len(order) {
+					old += fdist(last(j), first(j+1))
+					gain += fdist(first(i), first(j+1))
+				}
+				if gain < old-1e-9 {
+					for a, b := i, j; a < b; a, b = a+1, b-1 {
+						order[a], order[b] = order[b], order[a]
+					}
+					for k := i; k <= j; k++ {
+						order[k].Points = reversePoints(order[k].Points)
+					}
+					improved = true
+				}
+			}
 		}
 	}
+	return order
 }
 
+// penOrder groups paths by color, one pen per color in order of first
+// appearance.
+func penOrder(paths []plotPath) [][]plotPath {
+	var pens [][]plotPath
+	index := make(map[[3]int]int)
+	for _, p := range paths {
+		key := [3]int{p.R, p.G, p.B}
+		i, ok := index[key]
+		if !ok {
+			i = len(pens)
+			index[key] = i
+			pens = append(pens, nil)
+		}
+		pens[i] = append(pens[i], p)
+	}
+	return pens
+}
 
+// penChange fills in the --penchange template. {pen} is the pen number,
+// {r}, {g} and {b} its color.
+func penChange(template string, pen int, p plotPath) string {
+	return strings.NewReplacer(
+		"{pen}", strconv.Itoa(pen),
+		"{r}", strconv.Itoa(p.R),
+		"{g}", strconv.Itoa(p.G),
+		"{b}", strconv.Itoa(p.B),
+	).Replace(template)
+}
 
-func extractText(line string) string {
-	start := strings.Index(line, "'")
-	end := strings.LastIndex(line, "'")
-	if start == -1 || end == -1 || start == end {
-		return ""
+// writeGCode writes the scene as G-code for a pen plotter, in millimetres
+// with y pointing up and the canvas corner at the origin. Each color is
+// drawn with its own pen, announced by the pen change template.
+func writeGCode(w io.Writer, scene *Scene, opts plotOptions) error {
+	var b strings.Builder
+	coord := func(p fpoint) string {
+		return fmt.Sprintf("X%s Y%s", pdfNum(p.X*opts.Scale), pdfNum((float64(scene.Height)-p.Y)*opts.Scale))
 	}
-	return line[start+1 : end]
+	fmt.Fprintln(&b, "G21 ; millimetres")
+	fmt.Fprintln(&b, "G90 ; absolute coordinates")
+	fmt.Fprintln(&b, opts.PenUp)
+	for i, pen := range plotPens(scene, opts) {
+		fmt.Fprintln(&b, penChange(opts.PenChange, i+1, pen[0]))
+		for _, path := range pen {
+			fmt.Fprintf(&b, "G0 %s\n", coord(path.Points[0]))
+			fmt.Fprintln(&b, opts.PenDown)
+			fmt.Fprintf(&b, "G1 %s F%s\n", coord(path.Points[1]), pdfNum(opts.Feed))
+			for _, p := range path.Points[2:] {
+				fmt.Fprintf(&b, "G1 %s\n", coord(p))
+			}
+			fmt.Fprintln(&b, opts.PenUp)
+		}
+	}
+	fmt.Fprintln(&b, "G0 X0 Y0")
+	fmt.Fprintln(&b, "M2")
+	_, err := io.WriteString(w, b.String())
+	return err
 }
 
-func curveLine(start, end Point, strength, r, g, b int) string {
-	mx := (start.X + end.X) / 2
-	my := (start.Y + end.Y) / 2
-	color := fmt.Sprintf("rgb(%d,%d,%d)", r, g, b)
-	return fmt.Sprintf(`<path d="M %d %d Q %d %d %d %d" stroke="%s" fill="none" stroke-width="2"/>`,
-			   start.X, start.Y, mx, my-strength, end.X, end.Y, color)
+// writeHPGL writes the scene as HPGL in plotter units (40 per millimetre)
+// with y pointing up. Each color is selected as its own pen with SP, and
+// the feed rate is turned into a VS velocity in cm/s.
+func writeHPGL(w io.Writer, scene *Scene, opts plotOptions) error {
+	var b strings.Builder
+	coord := func(p fpoint) string {
+		x := math.Round(p.X * opts.Scale * 40)
+		y := math.Round((float64(scene.Height) - p.Y) * opts.Scale * 40)
+		return fmt.Sprintf("%d,%d", int(x), int(y))
+	}
+	b.WriteString("IN;\n")
+	for i, pen := range plotPens(scene, opts) {
+		fmt.Fprintf(&b, "SP%d;\nVS%s;\n", i+1, pdfNum(opts.Feed/600))
+		for _, path := range pen {
+			pts := make([]string, len(path.Points)-1)
+			for j, p := range path.Points[1:] {
+				pts[j] = coord(p)
+			}
+			fmt.Fprintf(&b, "PU%s;PD%s;\n", coord(path.Points[0]), strings.Join(pts, ","))
+		}
+	}
+	b.WriteString("PU;SP0;\n")
+	_, err := io.WriteString(w, b.String())
+	return err
 }
 
-func checkCommand(name string) bool {
-	_, err := exec.LookPath(name)
-	return err == nil
+// font5x7 is a 5x7 bitmap font for ASCII 32-126. Each glyph is five
+// columns, left to right, with bit 0 the top row.
+var font5x7 = [95][5]byte{
+	{0x00, 0x00, 0x00, 0x00, 0x00}, // ' '
+	{0x00, 0x00, 0x5F, 0x00, 0x00}, // !
+	{0x00, 0x07, 0x00, 0x07, 0x00}, // "
+	{0x14, 0x7F, 0x14, 0x7F, 0x14}, // #
+	{0x24, 0x2A, 0x7F, 0x2A, 0x12}, // $
+	{0x23, 0x13, 0x08, 0x64, 0x62}, // %
+	{0x36, 0x49, 0x55, 0x22, 0x50}, // &
+	{0x00, 0x05, 0x03, 0x00, 0x00}, // '
+	{0x00, 0x1C, 0x22, 0x41, 0x00}, // (
+	{0x00, 0x41, 0x22, 0x1C, 0x00}, // )
+	{0x14, 0x08, 0x3E, 0x08, 0x14}, // *
+	{0x08, 0x08, 0x3E, 0x08, 0x08}, // +
+	{0x00, 0x50, 0x30, 0x00, 0x00}, // ,
+	{0x08, 0x08, 0x08, 0x08, 0x08}, // -
+	{0x00, 0x60, 0x60, 0x00, 0x00}, // .
+	{0x20, 0x10, 0x08, 0x04, 0x02}, // /
+	{0x3E, 0x51, 0x49, 0x45, 0x3E}, // 0
+	{0x00, 0x42, 0x7F, 0x40, 0x00}, // 1
+	{0x42, 0x61, 0x51, 0x49, 0x46}, // 2
+	{0x21, 0x41, 0x45, 0x4B, 0x31}, // 3
+	{0x18, 0x14, 0x12, 0x7F, 0x10}, // 4
+	{0x27, 0x45, 0x45, 0x45, 0x39}, // 5
+	{0x3C, 0x4A, 0x49, 0x49, 0x30}, // 6
+	{0x01, 0x71, 0x09, 0x05, 0x03}, // 7
+	{0x36, 0x49, 0x49, 0x49, 0x36}, // 8
+	{0x06, 0x49, 0x49, 0x29, 0x1E}, // 9
+	{0x00, 0x36, 0x36, 0x00, 0x00}, // :
+	{0x00, 0x56, 0x36, 0x00, 0x00}, // ;
+	{0x08, 0x14, 0x22, 0x41, 0x00}, // <
+	{0x14, 0x14, 0x14, 0x14, 0x14}, // =
+	{0x00, 0x41, 0x22, 0x14, 0x08}, // >
+	{0x02, 0x01, 0x51, 0x09, 0x06}, // ?
+	{0x32, 0x49, 0x79, 0x41, 0x3E}, // @
+	{0x7E, 0x11, 0x11, 0x11, 0x7E}, // A
+	{0x7F, 0x49, 0x49, 0x49, 0x36}, // B
+	{0x3E, 0x41, 0x41, 0x41, 0x22}, // C
+	{0x7F, 0x41, 0x41, 0x22, 0x1C}, // D
+	{0x7F, 0x49, 0x49, 0x49, 0x41}, // E
+	{0x7F, 0x09, 0x09, 0x09, 0x01}, // F
+	{0x3E, 0x41, 0x49, 0x49, 0x7A}, // G
+	{0x7F, 0x08, 0x08, 0x08, 0x7F}, // H
+	{0x00, 0x41, 0x7F, 0x41, 0x00}, // I
+	{0x20, 0x40, 0x41, 0x3F, 0x01}, // J
+	{0x7F, 0x08, 0x14, 0x22, 0x41}, // K
+	{0x7F, 0x40, 0x40, 0x40, 0x40}, // L
+	{0x7F, 0x02, 0x0C, 0x02, 0x7F}, // M
+	{0x7F, 0x04, 0x08, 0x10, 0x7F}, // N
+	{0x3E, 0x41, 0x41, 0x41, 0x3E}, // O
+	{0x7F, 0x09, 0x09, 0x09, 0x06}, // P
+	{0x3E, 0x41, 0x51, 0x21, 0x5E}, // Q
+	{0x7F, 0x09, 0x19, 0x29, 0x46}, // R
+	{0x46, 0x49, 0x49, 0x49, 0x31}, // S
+	{0x01, 0x01, 0x7F, 0x01, 0x01}, // T
+	{0x3F, 0x40, 0x40, 0x40, 0x3F}, // U
+	{0x1F, 0x20, 0x40, 0x20, 0x1F}, // V
+	{0x3F, 0x40, 0x38, 0x40, 0x3F}, // W
+	{0x63, 0x14, 0x08, 0x14, 0x63}, // X
+	{0x07, 0x08, 0x70, 0x08, 0x07}, // Y
+	{0x61, 0x51, 0x49, 0x45, 0x43}, // Z
+	{0x00, 0x7F, 0x41, 0x41, 0x00}, // [
+	{0x02, 0x04, 0x08, 0x10, 0x20}, // \
+	{0x00, 0x41, 0x41, 0x7F, 0x00}, // ]
+	{0x04, 0x02, 0x01, 0x02, 0x04}, // ^
+	{0x40, 0x40, 0x40, 0x40, 0x40}, // _
+	{0x00, 0x01, 0x02, 0x04, 0x00}, // `
+	{0x20, 0x54, 0x54, 0x54, 0x78}, // a
+	{0x7F, 0x48, 0x44, 0x44, 0x38}, // b
+	{0x38, 0x44, 0x44, 0x44, 0x20}, // c
+	{0x38, 0x44, 0x44, 0x48, 0x7F}, // d
+	{0x38, 0x54, 0x54, 0x54, 0x18}, // e
+	{0x08, 0x7E, 0x09, 0x01, 0x02}, // f
+	{0x0C, 0x52, 0x52, 0x52, 0x3E}, // g
+	{0x7F, 0x08, 0x04, 0x04, 0x78}, // h
+	{0x00, 0x44, 0x7D, 0x40, 0x00}, // i
+	{0x20, 0x40, 0x44, 0x3D, 0x00}, // j
+	{0x7F, 0x10, 0x28, 0x44, 0x00}, // k
+	{0x00, 0x41, 0x7F, 0x40, 0x00}, // l
+	{0x7C, 0x04, 0x18, 0x04, 0x78}, // m
+	{0x7C, 0x08, 0x04, 0x04, 0x78}, // n
+	{0x38, 0x44, 0x44, 0x44, 0x38}, // o
+	{0x7C, 0x14, 0x14, 0x14, 0x08}, // p
+	{0x08, 0x14, 0x14, 0x18, 0x7C}, // q
+	{0x7C, 0x08, 0x04, 0x04, 0x08}, // r
+	{0x48, 0x54, 0x54, 0x54, 0x20}, // s
+	{0x04, 0x3F, 0x44, 0x40, 0x20}, // t
+	{0x3C, 0x40, 0x40, 0x20, 0x7C}, // u
+	{0x1C, 0x20, 0x40, 0x20, 0x1C}, // v
+	{0x3C, 0x40, 0x30, 0x40, 0x3C}, // w
+	{0x44, 0x28, 0x10, 0x28, 0x44}, // x
+	{0x0C, 0x50, 0x50, 0x50, 0x3C}, // y
+	{0x44, 0x64, 0x54, 0x4C, 0x44}, // z
+	{0x00, 0x08, 0x36, 0x41, 0x00}, // {
+	{0x00, 0x00, 0x7F, 0x00, 0x00}, // |
+	{0x00, 0x41, 0x36, 0x08, 0x00}, // }
+	{0x08, 0x04, 0x08, 0x10, 0x08}, // ~
 }
@@ -0,0 +1,695 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"image/gif"
+	"math"
+	"math/rand"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRenderImageFill(t *testing.T) {
+	scene := &Scene{
+		Width: 100, Height: 80,
+		BgR: 255, BgG: 255, BgB: 255,
+		Shapes: []Shape{
+			{Kind: "square", Points: []Point{{20, 20}}, Size: 40, R: 255, Fill: true},
+			{Kind: "circle", Points: []Point{{80, 60}}, Size: 10, B: 255, Fill: true},
+		},
+	}
+	img := renderImage(scene, 2)
+	if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != 200 || h != 160 {
+		t.Fatalf("size %dx%d, want 200x160", w, h)
+	}
+	tests := []struct {
+		x, y int
+		want color.RGBA
+	}{
+		{80, 80, color.RGBA{255, 0, 0, 255}},     // inside the square
+		{160, 120, color.RGBA{0, 0, 255, 255}},   // circle center
+		{10, 10, color.RGBA{255, 255, 255, 255}}, // background
+		{140, 40, color.RGBA{255, 255, 255, 255}},
+	}
+	for _, tt := range tests {
+		if got := img.RGBAAt(tt.x, tt.y); got != tt.want {
+			t.Errorf("pixel (%d,%d) = %v, want %v", tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+func TestRenderImageClip(t *testing.T) {
+	scene := &Scene{
+		Width: 100, Height: 100,
+		BgR: 255, BgG: 255, BgB: 255,
+		Shapes: []Shape{
+			{Kind: "square", Points: []Point{{0, 0}}, Size: 100, G: 255, Fill: true, Clip: 1},
+		},
+		Clips: []ClipRegion{{Kind: "rect", X: 0, Y: 0, W: 50, H: 100}},
+	}
+	img := renderImage(scene, 1)
+	if got, want := img.RGBAAt(25, 50), (color.RGBA{0, 255, 0, 255}); got != want {
+		t.Errorf("inside clip: %v, want %v", got, want)
+	}
+	if got, want := img.RGBAAt(75, 50), (color.RGBA{255, 255, 255, 255}); got != want {
+		t.Errorf("outside clip: %v, want %v", got, want)
+	}
+}
+
+func TestRenderImageTransparent(t *testing.T) {
+	scene := &Scene{
+		Width: 50, Height: 50,
+		Transparent: true,
+		Shapes: []Shape{
+			{Kind: "square", Points: []Point{{10, 10}}, Size: 20, R: 255, Fill: true},
+		},
+	}
+	img := renderImage(scene, 1)
+	if got := img.RGBAAt(40, 40); got.A != 0 {
+		t.Errorf("background alpha %d, want 0", got.A)
+	}
+	if got := img.RGBAAt(20, 20); got.A != 255 {
+		t.Errorf("shape alpha %d, want 255", got.A)
+	}
+}
+
+func TestSVGSceneRoundTrip(t *testing.T) {
+	files, err := filepath.Glob("Tests/*.lrlogic")
+	if err != nil || len(files) == 0 {
+		t.Fatal("no test files found")
+	}
+	for _, path := range files {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages, err := parseLRLogic(bytes.NewReader(src), false, false)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		var svg bytes.Buffer
+		writeSVG(&svg, pages[0])
+		scene, err := svgScene(svg.Bytes())
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		want, got := renderImage(pages[0], 1), renderImage(scene, 1)
+		if !bytes.Equal(want.Pix, got.Pix) {
+			t.Errorf("%s: SVG read back renders differently", path)
+		}
+	}
+}
+
+func TestSVGSceneForeign(t *testing.T) {
+	for _, src := range []string{
+		`<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"><path d="M 0 0 L 5 5" stroke="black"/></svg>`,
+		`<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"><ellipse cx="5" cy="5" rx="2" ry="3"/></svg>`,
+		`<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"><rect x="1.5" y="1" width="2" height="2"/></svg>`,
+	} {
+		if _, err := svgScene([]byte(src)); err != errForeignSVG {
+			t.Errorf("%s: got %v, want errForeignSVG", src, err)
+		}
+	}
+}
+
+// dxfPairs splits a DXF file into its group code and value pairs.
+func dxfPairs(t *testing.T, dxf string) [][2]string {
+	lines := strings.Split(strings.TrimSuffix(dxf, "\n"), "\n")
+	if len(lines)%2 != 0 {
+		t.Fatalf("odd number of DXF lines: %d", len(lines))
+	}
+	var pairs [][2]string
+	for i := 0; i < len(lines); i += 2 {
+		pairs = append(pairs, [2]string{strings.TrimSpace(lines[i]), lines[i+1]})
+	}
+	return pairs
+}
+
+func TestDXFLayerPerColor(t *testing.T) {
+	scene := &Scene{
+		Width: 100, Height: 100,
+		Shapes: []Shape{
+			{Kind: "line", Points: []Point{{0, 0}, {50, 50}}, R: 255},
+			{Kind: "circle", Points: []Point{{30, 20}}, Size: 10, B: 255},
+			{Kind: "square", Points: []Point{{60, 60}}, Size: 20, R: 255},
+		},
+	}
+	var buf bytes.Buffer
+	if err := writeDXF(&buf, scene, "mm", false); err != nil {
+		t.Fatal(err)
+	}
+	pairs := dxfPairs(t, buf.String())
+
+	var layers []string
+	entities := make(map[string]string) // entity kind -> layer
+	kind := ""
+	for i, p := range pairs {
+		switch {
+		case p[0] == "0":
+			kind = p[1]
+		case p[0] == "2" && kind == "LAYER":
+			layers = append(layers, p[1])
+		case p[0] == "8":
+			entities[kind] = p[1]
+		case p[0] == "9" && p[1] == "$INSUNITS":
+			if got := pairs[i+1][1]; got != "4" {
+				t.Errorf("$INSUNITS %s, want 4", got)
+			}
+		case p[0] == "20" && kind == "CIRCLE":
+			if p[1] != "80" {
+				t.Errorf("circle y %s, want 80 (flipped to y-up)", p[1])
+			}
+		}
+	}
+	wantLayers := []string{"0", "RGB_255_0_0", "RGB_0_0_255"}
+	if strings.Join(layers, " ") != strings.Join(wantLayers, " ") {
+		t.Errorf("layers %v, want %v", layers, wantLayers)
+	}
+	wantEntities := map[string]string{"LINE": "RGB_255_0_0", "CIRCLE": "RGB_0_0_255", "LWPOLYLINE": "RGB_255_0_0"}
+	for k, layer := range wantEntities {
+		if entities[k] != layer {
+			t.Errorf("%s on layer %q, want %q", k, entities[k], layer)
+		}
+	}
+
+	if err := writeDXF(&buf, scene, "furlong", false); err == nil {
+		t.Error("unknown units accepted")
+	}
+}
+
+func TestPlotterUnits(t *testing.T) {
+	scene := &Scene{
+		Width: 100, Height: 100,
+		Shapes: []Shape{
+			{Kind: "line", Points: []Point{{0, 0}, {100, 50}}, R: 255},
+			{Kind: "line", Points: []Point{{10, 90}, {20, 90}}, B: 255},
+		},
+	}
+	opts := plotOptions{Scale: 0.5, Tolerance: 0.1, Feed: 1200, PenUp: "M5", PenDown: "M3", PenChange: "T{pen} ; {r},{g},{b}"}
+
+	var gcode bytes.Buffer
+	if err := writeGCode(&gcode, scene, opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"G21 ; millimetres\n",
+		"T1 ; 255,0,0\nG0 X0 Y50\nM3\nG1 X50 Y25 F1200\nM5\n",
+		"T2 ; 0,0,255\nG0 X5 Y5\nM3\nG1 X10 Y5 F1200\nM5\n",
+	} {
+		if !strings.Contains(gcode.String(), want) {
+			t.Errorf("G-code is missing %q:\n%s", want, gcode.String())
+		}
+	}
+
+	var hpgl bytes.Buffer
+	if err := writeHPGL(&hpgl, scene, opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"SP1;\nVS2;\nPU0,2000;PD2000,1000;\n",
+		"SP2;\nVS2;\nPU200,200;PD400,200;\n",
+	} {
+		if !strings.Contains(hpgl.String(), want) {
+			t.Errorf("HPGL is missing %q:\n%s", want, hpgl.String())
+		}
+	}
+}
+
+func TestOptimizeStrokes(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var paths []plotPath
+	for i := 0; i < 200; i++ {
+		a := fpoint{rng.Float64() * 500, rng.Float64() * 500}
+		b := fpoint{a.X + rng.Float64()*40 - 20, a.Y + rng.Float64()*40 - 20}
+		paths = append(paths, plotPath{Points: []fpoint{a, b}})
+	}
+	start := fpoint{0, 500}
+	order := optimizeStrokes(append([]plotPath{}, paths...), start)
+
+	// Every stroke is drawn once, in either direction.
+	seen := make(map[[2]fpoint]int)
+	for _, p := range paths {
+		seen[[2]fpoint{p.Points[0], p.Points[1]}]++
+	}
+	for _, p := range order {
+		key := [2]fpoint{p.Points[0], p.Points[1]}
+		if seen[key] == 0 {
+			key = [2]fpoint{p.Points[1], p.Points[0]}
+		}
+		seen[key]--
+	}
+	for key, n := range seen {
+		if n != 0 {
+			t.Fatalf("stroke %v drawn %d times too few", key, n)
+		}
+	}
+
+	before := plotTravel([][]plotPath{paths}, start)
+	after := plotTravel([][]plotPath{order}, start)
+	if after > before {
+		t.Errorf("travel %.1f after optimizing, %.1f before", after, before)
+	}
+	// The result is a 2-opt local optimum: reversing any run of strokes
+	// does not shorten the travel.
+	for i := range order {
+		for j := i + 1; j < len(order); j++ {
+			trial := append([]plotPath{}, order...)
+			for a, b := i, j; a < b; a, b = a+1, b-1 {
+				trial[a], trial[b] = trial[b], trial[a]
+			}
+			for k := i; k <= j; k++ {
+				trial[k].Points = reversePoints(trial[k].Points)
+			}
+			if d := plotTravel([][]plotPath{trial}, start); d < after-1e-6 {
+				t.Fatalf("reversing strokes %d-%d shortens travel from %.3f to %.3f", i, j, after, d)
+			}
+		}
+	}
+}
+
+func TestMergeStrokes(t *testing.T) {
+	paths := []plotPath{
+		{Points: []fpoint{{0, 0}, {10, 0}}},
+		{Points: []fpoint{{20, 0}, {10, 0}}},
+		{Points: []fpoint{{20, 0}, {30, 0}}},
+		{Points: []fpoint{{50, 50}, {60, 60}}},
+	}
+	merged := mergeStrokes(paths)
+	if len(merged) != 2 {
+		t.Fatalf("%d strokes after merging, want 2", len(merged))
+	}
+	want := []fpoint{{0, 0}, {10, 0}, {20, 0}, {30, 0}}
+	if got := merged[0].Points; len(got) != len(want) || got[0] != want[0] || got[3] != want[3] {
+		t.Errorf("merged stroke %v, want %v", got, want)
+	}
+}
+
+func TestHatchLines(t *testing.T) {
+	square := []fpoint{{0, 0}, {100, 0}, {100, 100}, {0, 100}}
+	lines := hatchLines(square, 10, 0)
+	if len(lines) != 10 {
+		t.Fatalf("%d hatch lines, want 10", len(lines))
+	}
+	for i, l := range lines {
+		a, b := l[0], l[1]
+		if math.Abs(a.Y-b.Y) > 1e-9 || math.Abs(a.Y-float64(i*10+5)) > 1e-9 {
+			t.Errorf("line %d is %v, want horizontal at y=%d", i, l, i*10+5)
+		}
+		if math.Abs(math.Abs(b.X-a.X)-100) > 1e-9 {
+			t.Errorf("line %d is %v, want the full width", i, l)
+		}
+		if i > 0 && (b.X > a.X) == (lines[i-1][1].X > lines[i-1][0].X) {
+			t.Errorf("lines %d and %d run the same way", i-1, i)
+		}
+	}
+}
+
+func TestSVGSceneAnimated(t *testing.T) {
+	src := `LRFILE VERSION 2
+LRRESDEFINEX 200
+LRRESDEFINEY 200
+LRFILL ON
+LRCLIP RECT 0,0,100,200
+LRCIRCLE 100,100,40..255,0,0
+LRANIMATE 1 50,100,20..0,0,255
+LRCLIP END
+LRSQUARE 120,20,30..0,128,0
+LRANIMATE 1 140,40,10
+LREXIT
+`
+	pages, err := parseLRLogic(strings.NewReader(src), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var svg bytes.Buffer
+	writeSVG(&svg, pages[0])
+	if !strings.Contains(svg.String(), "<animate") {
+		t.Fatalf("no animation in the SVG:\n%s", svg.String())
+	}
+	scene, err := svgScene(svg.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scene.Shapes) != 2 || scene.Shapes[0].Clip != 1 {
+		t.Fatalf("read back %+v, want two shapes with the first clipped", scene.Shapes)
+	}
+	want, got := renderImage(pages[0], 1), renderImage(scene, 1)
+	if !bytes.Equal(want.Pix, got.Pix) {
+		t.Error("animated SVG read back renders differently from frame 0")
+	}
+}
+
+func TestGIFLoopCount(t *testing.T) {
+	tests := []struct {
+		loop      string
+		flag      int
+		loopCount int
+	}{
+		{"OFF", -1, -1},
+		{"1", -1, -1},
+		{"3", -1, 2},
+		{"ON", -1, 0},
+		{"ON", 1, -1},
+		{"OFF", 0, 0},
+	}
+	for _, tt := range tests {
+		src := "LRFILE VERSION 2\nLRLOOP " + tt.loop + "\n10,10,100,100..255,0,0\nLRPAGE\n10,100,100,10..0,0,255\nLREXIT\n"
+		pages, err := parseLRLogic(strings.NewReader(src), false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := writeGIF(&buf, pages, 0.25, gifOptions{Delay: 100, Loop: tt.flag, Colors: 16}); err != nil {
+			t.Fatal(err)
+		}
+		anim, err := gif.DecodeAll(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if anim.LoopCount != tt.loopCount {
+			t.Errorf("LRLOOP %s, --loop %d: LoopCount %d, want %d", tt.loop, tt.flag, anim.LoopCount, tt.loopCount)
+		}
+		if len(anim.Image) != 2 {
+			t.Errorf("%d frames, want 2", len(anim.Image))
+		}
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	tests := []struct {
+		header     string
+		legacyFlip bool
+		want       Point
+	}{
+		{"LRLOGIC FILE FORMAT V1", false, Point{100, 50}},
+		{"LRLOGIC FILE FORMAT V1", true, Point{100, 250}},
+		{"LRLOGIC FILE FORMAT V1\nLRORIGIN BOTTOMLEFT", false, Point{100, 250}},
+		{"LRFILE VERSION 2", false, Point{100, 250}},
+		{"LRFILE VERSION 2\nLRORIGIN TOPLEFT", true, Point{100, 50}},
+		{"LRFILE VERSION 2\nLRORIGIN CENTER", false, Point{300, 100}},
+	}
+	for _, tt := range tests {
+		src := tt.header + "\nLRRESDEFINEX 400\nLRRESDEFINEY 300\n100,50,200,50..255,0,0\nLREXIT\n"
+		pages, err := parseLRLogic(strings.NewReader(src), false, tt.legacyFlip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := pages[0].Shapes[0].Points[0]; got != tt.want {
+			t.Errorf("%q, legacy flip %v: line starts at %v, want %v", tt.header, tt.legacyFlip, got, tt.want)
+		}
+	}
+}
+
+// TestReferences checks the fixtures like the verify subcommand: Tests
+// with --legacy-flip, Tests/origin without.
+func TestReferences(t *testing.T) {
+	for _, dir := range []struct {
+		tests, refs string
+		legacyFlip  bool
+	}{
+		{"Tests", "tests_rendered", true},
+		{"Tests/origin", "tests_rendered/origin", false},
+	} {
+		files, _ := filepath.Glob(filepath.Join(dir.tests, "*.lrlogic"))
+		if len(files) == 0 {
+			t.Fatalf("no test files in %s", dir.tests)
+		}
+		for _, path := range files {
+			src, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pages, err := parseLRLogic(bytes.NewReader(src), false, dir.legacyFlip)
+			if err != nil {
+				t.Fatalf("%s: %v", path, err)
+			}
+			var svg bytes.Buffer
+			writeSVG(&svg, pages[0])
+			name := strings.TrimSuffix(filepath.Base(path), ".lrlogic")
+			diffs, err := verifySVG(filepath.Join(dir.refs, name+".svg"), svg.Bytes())
+			if err != nil || len(diffs) > 0 {
+				t.Errorf("%s: %v %v", path, err, diffs)
+			}
+		}
+	}
+}
+
+func TestViewBox(t *testing.T) {
+	src := "LRFILE VERSION 2\nLRRESDEFINEX 800\nLRRESDEFINEY 400\nLRVIEWBOX -100,-50,200,100\nLRFILL ON\nLRCIRCLE 0,0,10..255,0,0\nLRCIRCLE 90,40,5..0,0,255\nLREXIT\n"
+	pages, err := parseLRLogic(strings.NewReader(src), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scene := pages[0]
+	if scene.Width != 200 || scene.Height != 100 || scene.OutputWidth != 800 || scene.OutputHeight != 400 {
+		t.Fatalf("scene %dx%d drawn at %dx%d, want 200x100 at 800x400",
+			scene.Width, scene.Height, scene.OutputWidth, scene.OutputHeight)
+	}
+	if got, want := scene.Shapes[0].Points[0], (Point{100, 50}); got != want {
+		t.Errorf("0,0 maps to %v, want %v", got, want)
+	}
+	if got, want := scene.Shapes[1].Points[0], (Point{190, 10}); got != want {
+		t.Errorf("90,40 maps to %v, want %v", got, want)
+	}
+	if s := scene.pixelScale(); s != 4 {
+		t.Errorf("pixel scale %v, want 4", s)
+	}
+
+	var svg bytes.Buffer
+	writeSVG(&svg, scene)
+	if root := `width="800" height="400" viewBox="0 0 200 100"`; !strings.Contains(svg.String(), root) {
+		t.Errorf("SVG root is missing %s:\n%s", root, svg.String())
+	}
+	back, err := svgScene(svg.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.Width != 200 || back.OutputWidth != 800 || back.OutputHeight != 400 {
+		t.Errorf("SVG read back as %dx%d at %dx%d", back.Width, back.Height, back.OutputWidth, back.OutputHeight)
+	}
+
+	img := renderImage(scene, scene.pixelScale())
+	if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != 800 || h != 400 {
+		t.Fatalf("rendered %dx%d, want 800x400", w, h)
+	}
+	if got, want := img.RGBAAt(400, 200), (color.RGBA{255, 0, 0, 255}); got != want {
+		t.Errorf("pixel at the view box origin %v, want %v", got, want)
+	}
+	if got, want := img.RGBAAt(760, 40), (color.RGBA{0, 0, 255, 255}); got != want {
+		t.Errorf("pixel at 90,40 %v, want %v", got, want)
+	}
+}
+
+func TestOutputSize(t *testing.T) {
+	src := "LRFILE VERSION 2\nLRRESDEFINEX 200\nLRRESDEFINEY 100\n10,10,190,90..255,0,0\nLREXIT\n"
+	pages, err := parseLRLogic(strings.NewReader(src), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		opts outputOptions
+		w, h int
+		root string
+	}{
+		{outputOptions{}, 200, 100, `width="200" height="100">`},
+		{outputOptions{Width: 100}, 100, 50, `width="100" height="50" viewBox="0 0 200 100"`},
+		{outputOptions{Height: 300}, 600, 300, `width="600" height="300" viewBox="0 0 200 100"`},
+		{outputOptions{Width: 400, Height: 400}, 400, 200, `width="400" height="200" viewBox="0 0 200 100"`},
+		{outputOptions{Responsive: true}, 200, 100, `width="100%" height="100%" viewBox="0 0 200 100"`},
+	}
+	for _, tt := range tests {
+		scene := tt.opts.resize(pages)[0]
+		img := renderImage(scene, scene.pixelScale())
+		if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != tt.w || h != tt.h {
+			t.Errorf("%+v: rendered %dx%d, want %dx%d", tt.opts, w, h, tt.w, tt.h)
+		}
+		var svg bytes.Buffer
+		writeSVG(&svg, scene)
+		if !strings.Contains(svg.String(), tt.root) {
+			t.Errorf("%+v: SVG root is missing %s:\n%s", tt.opts, tt.root, svg.String())
+		}
+	}
+	if pages[0].OutputWidth != 0 || pages[0].Responsive {
+		t.Error("resize changed the parsed page")
+	}
+}
+
+func TestStrokeStyleCommands(t *testing.T) {
+	src := `LRFILE VERSION 2
+LRDASH 4,2
+LRCAP round
+LRJOIN bevel
+10,10,100,10..0,0,0
+LRDASH 0,0
+LRCAP default
+LRJOIN DEFAULT
+10,20,100,20..0,0,0
+LREXIT
+`
+	pages, err := parseLRLogic(strings.NewReader(src), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shapes := pages[0].Shapes
+	if got := shapes[0].Style; len(got.Dash) != 2 || got.Cap != "round" || got.Join != "bevel" {
+		t.Errorf("first line style %+v, want dash 4,2 with round caps and bevel joins", got)
+	}
+	if got := shapes[1].Style; len(got.Dash) != 2 || got.Cap != "" || got.Join != "" {
+		t.Errorf("second line style %+v, want dash 4,2 with default caps and joins", got)
+	}
+	if w := pages[0].Warnings; len(w) != 1 || !strings.Contains(w[0], "LRDASH") {
+		t.Errorf("warnings %q, want one for LRDASH 0,0", w)
+	}
+}
+
+func TestServePages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pages.lrlogic")
+	src := "LRFILE VERSION 2\nLRCLIP RECT 0,0,100,100\nLRCIRCLE 100,50,40..255,0,0\nLRCLIP END\nLRPAGE\nLRCLIP RECT 100,0,100,100\nLRCIRCLE 100,50,40..0,0,255\nLRCLIP END\nLREXIT\n"
+	if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := &previewServer{path: path, changed: make(chan struct{})}
+	p.update()
+
+	rec := httptest.NewRecorder()
+	p.serveContent(rec, httptest.NewRequest("GET", "/content", nil))
+	content := rec.Body.String()
+	if strings.Contains(content, "<svg") || strings.Count(content, "<img") != 2 {
+		t.Errorf("content should hold one image per page:\n%s", content)
+	}
+
+	for i, want := range []string{"rgb(255,0,0)", "rgb(0,0,255)"} {
+		rec := httptest.NewRecorder()
+		p.servePageSVG(rec, httptest.NewRequest("GET", fmt.Sprintf("/page/%d.svg", i+1), nil))
+		if rec.Code != 200 || !strings.Contains(rec.Body.String(), want) || strings.Count(rec.Body.String(), "<svg") != 1 {
+			t.Errorf("page %d: %d\n%s", i+1, rec.Code, rec.Body.String())
+		}
+	}
+	rec = httptest.NewRecorder()
+	p.servePageSVG(rec, httptest.NewRequest("GET", "/page/3.svg", nil))
+	if rec.Code != 404 {
+		t.Errorf("page 3: %d, want 404", rec.Code)
+	}
+}
+
+func TestWriteLRLogicStyleReset(t *testing.T) {
+	src := `LRFILE VERSION 2
+LRRESDEFINEX 300
+LRRESDEFINEY 200
+LRCLIP RECT 0,0,150,200
+LRCAP round
+LRJOIN bevel
+10,10,100,100..255,0,0
+LRCLIP END
+LRCAP default
+LRJOIN default
+LRCLIP RECT 150,0,150,200
+LRSQUARE 200,100,30..0,0,255
+LRCLIP END
+LREXIT
+`
+	pages, err := parseLRLogic(strings.NewReader(src), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := writeLRLogic(&buf, pages); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkRoundTrip(buf.Bytes(), pages); err != nil {
+		t.Errorf("%v\n%s", err, buf.String())
+	}
+}
+
+func TestFromJSONMismatch(t *testing.T) {
+	pages, err := parseLRLogic(strings.NewReader("LRFILE VERSION 2\nLREXIT\n"), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A polygon without fill has no .lrlogic form.
+	pages[0].Shapes = []Shape{{
+		Kind:   "polygon",
+		Points: []Point{{10, 10}, {50, 10}, {50, 50}},
+		R:      255,
+	}}
+
+	dir := t.TempDir()
+	in := filepath.Join(dir, "scene.json")
+	out := filepath.Join(dir, "scene.lrlogic")
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, pages); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(in, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code := runFromJSON([]string{"--out", out, in}); code != 1 {
+		t.Errorf("exit code %d, want 1", code)
+	}
+	if _, err := os.Stat(out); err == nil {
+		t.Errorf("%s was written despite the mismatch", out)
+	}
+}
+
+func TestDXFOptimize(t *testing.T) {
+	// The source order zigzags across the canvas; the second line is
+	// written backwards to show its start marker is kept on its end.
+	scene := &Scene{
+		Width: 100, Height: 100,
+		Shapes: []Shape{
+			{Kind: "line", Points: []Point{{0, 100}, {10, 100}}},
+			{Kind: "circle", Points: []Point{{50, 50}}, Size: 5},
+			{Kind: "line", Points: []Point{{20, 0}, {90, 0}}},
+			{Kind: "line", Points: []Point{{20, 100}, {10, 100}}, Markers: LineMarkers{Start: "dot"}},
+		},
+	}
+	var plain, optimized bytes.Buffer
+	if err := writeDXF(&plain, scene, "mm", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeDXF(&optimized, scene, "mm", true); err != nil {
+		t.Fatal(err)
+	}
+
+	starts := func(dxf string) []string {
+		var xs []string
+		kind := ""
+		for _, p := range dxfPairs(t, dxf) {
+			switch {
+			case p[0] == "0":
+				kind = p[1]
+			case (kind == "LINE" || kind == "CIRCLE") && p[0] == "10":
+				xs = append(xs, kind+" "+p[1])
+			}
+		}
+		return xs
+	}
+	if got, want := strings.Join(starts(plain.String()), ", "), "LINE 0, CIRCLE 50, LINE 20, LINE 20"; got != want {
+		t.Errorf("plain order %s, want %s", got, want)
+	}
+	if got, want := strings.Join(starts(optimized.String()), ", "), "LINE 0, LINE 10, LINE 20, CIRCLE 50"; got != want {
+		t.Errorf("optimized order %s, want %s", got, want)
+	}
+	kind, dots := "", 0
+	for _, p := range dxfPairs(t, optimized.String()) {
+		switch {
+		case p[0] == "0":
+			kind = p[1]
+		case kind == "LWPOLYLINE" && p[0] == "10":
+			dots++
+			if x, _ := strconv.ParseFloat(p[1], 64); math.Abs(x-20) > 3 {
+				t.Errorf("dot marker point at x %s, want it around 20", p[1])
+			}
+		}
+	}
+	if dots == 0 {
+		t.Error("the dot marker was lost")
+	}
+}
@@ -9,8 +9,8 @@ from concurrent.futures import ProcessPoolExecutor, as_completed
 def detect_os():
     return 'lrlogic.exe' if os.name == 'nt' else './lrlogic'
 
-def worker(i, width, height, maxshapes, shape_weights, render, cleanup):
-    filename = f"output_{i}.lrlogic"
+def worker(i, width, height, maxshapes, shape_weights):
+    filename = os.path.join("randomgen", f"output_{i}.lrlogic")
     shape_types = ['line', 'circle', 'square']
     shape_count = random.randint(1, maxshapes)
     curve = random.randint(0, 10)
@@ -40,23 +40,18 @@ def worker(i, width, height, maxshapes, shape_weights, render, cleanup):
                 size = random.randint(10, min(width, height) // 3)
                 f.write(f"LRSQUARE {x},{y},{size}..{r},{g},{b}\n")
         f.write("LREXIT\n")
-
-    if render:
-        lrlogic_exec = detect_os()
-        if not os.path.exists(lrlogic_exec):
-            print(f"Warning: {lrlogic_exec} not found. Skipping rendering.")
-            return
-        subprocess.run([lrlogic_exec, '-file', filename, '-verbose', '-nosvg'], stdout=subprocess.DEVNULL)
-
-    os.rename(filename, os.path.join("randomgen", filename))
-    jpgname = f"output_{i}.jpg"
-    if os.path.exists(jpgname):
-        os.rename(jpgname, os.path.join("randomgen", jpgname))
-
-    if cleanup:
-        logic_path = os.path.join("randomgen", filename)
-        if os.path.exists(logic_path):
-            os.remove(logic_path)
+    return filename
+
+def render_all(filenames):
+    # One lrlogic process renders the whole batch with its own worker pool
+    lrlogic_exec = detect_os()
+    if not os.path.exists(lrlogic_exec):
+        print(f"Warning: {lrlogic_exec} not found. Skipping rendering.")
+        return
+    result = subprocess.run([lrlogic_exec, 'render', '-nosvg', '-outdir', 'randomgen', '-force'] + filenames, stdout=subprocess.PIPE, text=True)
+    for line in result.stdout.splitlines():
+        if line.startswith("FAILED") or line.startswith("Rendered"):
+            print(line)
 
 def main():
     os.makedirs("randomgen", exist_ok=True)
@@ -109,11 +104,18 @@ def main():
 
     with ProcessPoolExecutor() as executor:
         tasks = [
-            executor.submit(worker, i+1, args.width, args.height, args.maxshapes, shape_weights, args.render, args.cleanup)
+            executor.submit(worker, i+1, args.width, args.height, args.maxshapes, shape_weights)
             for i in range(args.count)
         ]
-        for _ in as_completed(tasks):
-            pass
+        filenames = sorted(task.result() for task in as_completed(tasks))
+
+    if args.render:
+        render_all(filenames)
+
+    if args.cleanup:
+        for filename in filenames:
+            if os.path.exists(filename):
+                os.remove(filename)
 
     elapsed_time = time.time() - start_time
     print(f"Done! Time elapsed: {elapsed_time:.2f} seconds")
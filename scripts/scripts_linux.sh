@@ -41,15 +41,19 @@ case $choice in
       if [[ -f "$file" ]]; then
         echo "Processing $file..."
         if [[ "$keep_svg" == "n" ]]; then
-          $PROGRAM --file "$file" --nosvg --verbose
+          $PROGRAM --file "$file" --nosvg --legacy-flip --verbose
         else
-          $PROGRAM --file "$file" --verbose
+          $PROGRAM --file "$file" --legacy-flip --verbose
         fi
         echo ""
       fi
     done
     rm *.lrlogic
 
+    echo "Comparing with tests_rendered..."
+    $PROGRAM verify --legacy-flip
+    $PROGRAM verify --tests Tests/origin --refs tests_rendered/origin
+
     # Capture end time and calculate elapsed time
     end_time=$(date +%s)
     elapsed_time=$((end_time - start_time))
@@ -75,17 +79,11 @@ case $choice in
     rm *.svg
     rm *.jpg
 
-    for file in *.lrlogic; do
-        if [[ -f "$file" ]]; then
-            echo "Processing $file..."
-            if [[ "$keep_svg" == "n" ]]; then
-                $PROGRAM --file "$file" --nosvg --verbose
-            else
-                $PROGRAM --file "$file" --verbose
-            fi
-            echo ""
-        fi
-    done
+    if [[ "$keep_svg" == "n" ]]; then
+        $PROGRAM render --nosvg '*.lrlogic'
+    else
+        $PROGRAM render '*.lrlogic'
+    fi
 
     # Capture end time and calculate elapsed time
     end_time=$(date +%s)
@@ -35,15 +35,19 @@ switch ($choice) {
         Get-ChildItem -Filter *.lrlogic | ForEach-Object {
             Write-Host "Processing $($_.Name)..."
             if ($keep_svg -eq "n") {
-                .\lrlogic.exe --file $_.Name --nosvg --verbose
+                .\lrlogic.exe --file $_.Name --nosvg --legacy-flip --verbose
             } else {
-                .\lrlogic.exe --file $_.Name --verbose
+                .\lrlogic.exe --file $_.Name --legacy-flip --verbose
             }
             Write-Host
         }
 
         Remove-Item *.lrlogic -ErrorAction SilentlyContinue
 
+        Write-Host "Comparing with tests_rendered..."
+        .\lrlogic.exe verify --legacy-flip
+        .\lrlogic.exe verify --tests Tests\origin --refs tests_rendered\origin
+
         $elapsed = (Get-Date) - $startTime
         Write-Host "Full Test complete."
         Write-Host "Elapsed Time: $($elapsed.TotalSeconds) seconds."
@@ -64,14 +68,10 @@ switch ($choice) {
 
         Remove-Item *.svg, *.jpg -ErrorAction SilentlyContinue
 
-        Get-ChildItem -Filter *.lrlogic | ForEach-Object {
-            Write-Host "Processing $($_.Name)..."
-            if ($keep_svg -eq "n") {
-                .\lrlogic.exe --file $_.Name --nosvg --verbose
-            } else {
-                .\lrlogic.exe --file $_.Name --verbose
-            }
-            Write-Host
+        if ($keep_svg -eq "n") {
+            .\lrlogic.exe render --nosvg '*.lrlogic'
+        } else {
+            .\lrlogic.exe render '*.lrlogic'
         }
 
         $elapsed = (Get-Date) - $startTime
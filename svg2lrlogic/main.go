@@ -68,9 +68,15 @@ func main() {
 
 	decoder := xml.NewDecoder(strings.NewReader(string(data)))
 	var output []string
-	output = append(output, "LRFILE VERSION 2")
+	// SVG puts 0,0 at the top left with y pointing down, so the
+	// coordinates are written as they are.
+	output = append(output, "LRFILE VERSION 2", "LRORIGIN TOPLEFT")
 
 	width, height := 640, 480
+	background := false
+	// hidden counts the open elements inside <defs>, <clipPath> or
+	// <marker>. Clip paths and markers are not drawn themselves.
+	hidden := 0
 	fillState := ""
 	lastFill := ""
 	output = append(output, "LRMARGIN 20 20", "LRFONTSIZE 16", "LRCURVE 5")
@@ -82,7 +88,22 @@ func main() {
 		}
 
 		switch elem := tok.(type) {
+		case xml.EndElement:
+			if hidden > 0 {
+				hidden--
+			}
 		case xml.StartElement:
+			switch name := elem.Name.Local; {
+			case hidden > 0:
+				hidden++
+				continue
+			case name == "defs" || name == "clipPath" || name == "marker":
+				hidden = 1
+				if *verbose {
+					fmt.Printf("Skipping <%s>\n", name)
+				}
+				continue
+			}
 			switch elem.Name.Local {
 			case "svg":
 				for _, attr := range elem.Attr {
@@ -98,6 +119,7 @@ func main() {
 			case "rect":
 				x, y, w, h := 0, 0, 0, 0
 				fill := "none"
+				hasStroke := false
 				rCol, gCol, bCol := 0, 0, 0
 				for _, attr := range elem.Attr {
 					switch attr.Name.Local {
@@ -112,16 +134,27 @@ func main() {
 					case "fill":
 						fill = attr.Value
 					case "stroke":
+						hasStroke = true
 						rCol, gCol, bCol = parseRGB(attr.Value)
 					}
 				}
-				if w == width && h == height && strings.TrimSpace(fill) == "white" {
+				// A full-size, unstroked rect at the origin is the canvas
+				// background written by LRBACKGROUND (white by default).
+				if w == width && h == height && x == 0 && y == 0 && !hasStroke {
+					background = true
+					fill = strings.TrimSpace(fill)
+					if fill != "white" && strings.HasPrefix(fill, "rgb(") {
+						bgR, bgG, bgB := parseRGB(fill)
+						output = append(output, fmt.Sprintf("LRBACKGROUND %d,%d,%d", bgR, bgG, bgB))
+						if *verbose {
+							fmt.Printf("Parsed background: rgb(%d,%d,%d)\n", bgR, bgG, bgB)
+						}
+					}
 					continue // skip background
 				}
 				if w <= 0 || h <= 0 {
 					continue
 				}
-				y = height - y - h
 				fillState = "OFF"
 				if fill != "none" {
 					fillState = "ON"
@@ -153,7 +186,6 @@ func main() {
 				if r <= 0 {
 					continue
 				}
-				y = height - y
 				fillState = "OFF"
 				if fill != "none" {
 					fillState = "ON"
@@ -180,8 +212,6 @@ func main() {
 						rCol, gCol, bCol = parseRGB(attr.Value)
 					}
 				}
-				y1 = height - y1
-				y2 = height - y2
 				if lastFill != "OFF" {
 					output = append(output, "LRFILL OFF")
 					lastFill = "OFF"
@@ -215,15 +245,13 @@ func main() {
 						if i+4 < len(tokens) {
 							x2, _ := strconv.Atoi(tokens[i+3])
 							y2, _ := strconv.Atoi(tokens[i+4])
-							y1i := height - y1
-							y2i := height - y2
 							if lastFill != "OFF" {
 								output = append(output, "LRFILL OFF")
 								lastFill = "OFF"
 							}
-							output = append(output, fmt.Sprintf("%d,%d,%d,%d..%d,%d,%d", x1, y1i, x2, y2i, rCol, gCol, bCol))
+							output = append(output, fmt.Sprintf("%d,%d,%d,%d..%d,%d,%d", x1, y1, x2, y2, rCol, gCol, bCol))
 							if *verbose {
-								fmt.Printf("Parsed path segment: (%d,%d) to (%d,%d) rgb(%d,%d,%d)\n", x1, y1i, x2, y2i, rCol, gCol, bCol)
+								fmt.Printf("Parsed path segment: (%d,%d) to (%d,%d) rgb(%d,%d,%d)\n", x1, y1, x2, y2, rCol, gCol, bCol)
 							}
 							x1 = x2
 							y1 = y2
@@ -264,8 +292,6 @@ func main() {
 					y1, _ := strconv.Atoi(p1[1])
 					x2, _ := strconv.Atoi(p2[0])
 					y2, _ := strconv.Atoi(p2[1])
-					y1 = height - y1
-					y2 = height - y2
 					output = append(output, fmt.Sprintf("%d,%d,%d,%d..%d,%d,%d", x1, y1, x2, y2, rCol, gCol, bCol))
 				}
 			case "text":
@@ -292,6 +318,11 @@ func main() {
 		}
 	}
 
+	// Without a background rect the SVG is transparent, while a .lrlogic
+	// file is white unless told otherwise.
+	if !background {
+		output = append(output, "LRBACKGROUND NONE")
+	}
 	output = append(output, "LREXIT")
 
 	outFile := strings.TrimSuffix(filepath.Base(*fileFlag), filepath.Ext(*fileFlag)) + ".lrlogic"
@@ -367,7 +398,7 @@ func parseRGB(rgb string) (int, int, int) {
 	return r, g, b
 }
 
-func convertTransformedPathsToLines(paths []xml.StartElement, transform string, height int, verbose bool) []string {
+func convertTransformedPathsToLines(paths []xml.StartElement, transform string, verbose bool) []string {
 	var output []string
 	scaleX, scaleY := 1.0, 1.0
 	translateX, translateY := 0.0, 0.0
@@ -442,11 +473,9 @@ func convertTransformedPathsToLines(paths []xml.StartElement, transform string,
 					y2f, _ := strconv.ParseFloat(tokens[i+4], 64)
 					x2 := int(x2f*scaleX + translateX)
 					y2 := int(y2f*scaleY + translateY)
-					y1i := height - y1
-					y2i := height - y2
-					output = append(output, fmt.Sprintf("%d,%d,%d,%d..%d,%d,%d", x1, y1i, x2, y2i, rCol, gCol, bCol))
+					output = append(output, fmt.Sprintf("%d,%d,%d,%d..%d,%d,%d", x1, y1, x2, y2, rCol, gCol, bCol))
 					if verbose {
-						fmt.Printf("Transformed path line: (%d,%d) to (%d,%d) rgb(%d,%d,%d)\n", x1, y1i, x2, y2i, rCol, gCol, bCol)
+						fmt.Printf("Transformed path line: (%d,%d) to (%d,%d) rgb(%d,%d,%d)\n", x1, y1, x2, y2, rCol, gCol, bCol)
 					}
 					x1 = x2
 					y1 = y2
@@ -577,7 +606,7 @@ def main():
 	# Start measuring time
     start_time = time.time()
 
-    output = ["LRFILE VERSION 2", "LRFILL OFF"]
+    output = ["LRFILE VERSION 2", "LRORIGIN TOPLEFT", "LRFILL OFF"]
 
     width = root.get('width')
     height = root.get('height')
@@ -623,9 +652,9 @@ def main():
 
     for x1, y1, x2, y2, r, g_col, b in all_lines:
         nx1 = int(round(x1 + shift_x))
-        ny1 = int(round(h - (y1 + shift_y)))  # Vertical flip
+        ny1 = int(round(y1 + shift_y))
         nx2 = int(round(x2 + shift_x))
-        ny2 = int(round(h - (y2 + shift_y)))  # Vertical flip
+        ny2 = int(round(y2 + shift_y))
         output.append(f"{nx1},{ny1},{nx2},{ny2}..{r},{g_col},{b}")
 
     output.append("LREXIT")
@@ -104,7 +104,7 @@ def main():
 	# Start measuring time
     start_time = time.time()
 
-    output = ["LRFILE VERSION 2", "LRFILL OFF"]
+    output = ["LRFILE VERSION 2", "LRORIGIN TOPLEFT", "LRFILL OFF"]
 
     width = root.get('width')
     height = root.get('height')
@@ -150,9 +150,9 @@ def main():
 
     for x1, y1, x2, y2, r, g_col, b in all_lines:
         nx1 = int(round(x1 + shift_x))
-        ny1 = int(round(h - (y1 + shift_y)))  # Vertical flip
+        ny1 = int(round(y1 + shift_y))
         nx2 = int(round(x2 + shift_x))
-        ny2 = int(round(h - (y2 + shift_y)))  # Vertical flip
+        ny2 = int(round(y2 + shift_y))
         output.append(f"{nx1},{ny1},{nx2},{ny2}..{r},{g_col},{b}")
 
     output.append("LREXIT")